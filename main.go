@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"image/png"
 	"os"
+	"path/filepath"
 	"runtime/pprof"
+	"strings"
 
 	"github.com/alberthier/pathtracer"
 )
@@ -17,7 +19,12 @@ func main() {
 	startframe := flag.Int("startframe", 1, "Animation start frame")
 	length := flag.Int("length", 1, "Animation length (frames)")
 	cpuprofile := flag.String("cpuprofile", "", "CPU profile file")
-	prefix := flag.String("prefix", "", "Output file prefix")
+	prefix := flag.String("prefix", "", "Output file prefix, its extension selects the format: .png (default), .pfm, .hdr or .exr")
+	compression := flag.String("compression", "zip", "EXR compression: zip or none")
+	exposure := flag.Float64("exposure", 0.0, "Exposure in stops, overrides the scene film settings")
+	tonemap := flag.String("tonemap", "clamp", "Tone mapping: clamp, reinhard, filmic or aces, overrides the scene film settings")
+	gamma := flag.Float64("gamma", 0.0, "Display gamma, 0 for sRGB, overrides the scene film settings")
+	spectral := flag.Bool("spectral", false, "Spectral rendering with hero wavelength sampling and dispersion")
 
 	flag.Parse()
 
@@ -28,24 +35,83 @@ func main() {
 		os.Exit(1)
 	}
 
+	// The frame number goes between the prefix and its extension
+	format := "png"
+	if ext := filepath.Ext(*prefix); len(ext) != 0 {
+		format = strings.ToLower(ext[1:])
+		*prefix = strings.TrimSuffix(*prefix, ext)
+	}
+	switch format {
+	case "png", "pfm", "hdr", "exr":
+		break
+	default:
+		fmt.Printf("Unsupported output format: '%s'\n", format)
+		os.Exit(1)
+	}
+	exrCompression, ok := pathtracer.NewEXRCompression(*compression)
+	if !ok {
+		fmt.Printf("Unknown EXR compression: '%s'\n", *compression)
+		os.Exit(1)
+	}
+
 	world := pathtracer.NewWorld()
 	err := world.Load(worldFile, float64(*width)/float64(*height))
 	if err != nil {
 		fmt.Println(err)
 	}
 
+	// Only flags given on the command line override the scene film
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "exposure":
+			world.Film.Exposure = *exposure
+			break
+		case "tonemap":
+			toneMapping, ok := pathtracer.NewToneMapping(*tonemap)
+			if !ok {
+				fmt.Printf("Unknown tone mapping: '%s'\n", *tonemap)
+				os.Exit(1)
+			}
+			world.Film.ToneMapping = toneMapping
+			break
+		case "gamma":
+			world.Film.Gamma = *gamma
+			break
+		}
+	})
+
 	if len(*cpuprofile) != 0 {
 		f, _ := os.Create("cpuprofile")
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
 	}
 
-	renderer := pathtracer.NewRenderer(*width, *height, *samples)
+	renderer := pathtracer.NewRenderer(*width, *height, *samples, *spectral)
 	for t := *startframe; t < (*startframe + *length); t++ {
 		logprefix := fmt.Sprintf("Frame %d/%d - ", t+1, *length)
 		img := renderer.Render(world, float64(t), logprefix)
-		output, _ := os.Create(fmt.Sprintf("%s%03d.png", *prefix, t))
-		png.Encode(output, img)
+		output, err := os.Create(fmt.Sprintf("%s%03d.%s", *prefix, t, format))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		switch format {
+		case "png":
+			err = png.Encode(output, img.ToRGBA(world.Film))
+			break
+		case "pfm":
+			err = img.WritePFM(output)
+			break
+		case "hdr":
+			err = img.WriteHDR(output)
+			break
+		case "exr":
+			err = img.WriteEXR(output, exrCompression)
+			break
+		}
 		output.Close()
+		if err != nil {
+			fmt.Println(err)
+		}
 	}
 }
@@ -4,18 +4,46 @@ import (
 	"math"
 )
 
+// Animations are evaluated at any time by At, without changing the animation.
+// Update only computes the bounds covering the shutter interval [t0, t1] of a
+// frame.
+
 type AnimatedValue interface {
-	Update(t float64)
-	Get() float64
+	Update(t0 float64, t1 float64)
+	At(t float64) float64
+	Range() (float64, float64)
 	Clone(initialValue float64) AnimatedValue
 }
 
 type AnimatedVector interface {
-	Update(t float64)
-	Get() *Vector3
+	Update(t0 float64, t1 float64)
+	At(t float64) *Vector3
+	Bounds() *AABB
 	Clone() AnimatedVector
 }
 
+// Range of sin over the angles [a0, a1]
+func sinRange(a0 float64, a1 float64) (float64, float64) {
+	if a1 < a0 {
+		a0, a1 = a1, a0
+	}
+	if a1-a0 >= 2.0*math.Pi {
+		return -1.0, 1.0
+	}
+	lo := math.Min(math.Sin(a0), math.Sin(a1))
+	hi := math.Max(math.Sin(a0), math.Sin(a1))
+	// First peak and trough after a0
+	peak := math.Pi/2.0 + 2.0*math.Pi*math.Ceil((a0-math.Pi/2.0)/(2.0*math.Pi))
+	trough := -math.Pi/2.0 + 2.0*math.Pi*math.Ceil((a0+math.Pi/2.0)/(2.0*math.Pi))
+	if peak <= a1 {
+		hi = 1.0
+	}
+	if trough <= a1 {
+		lo = -1.0
+	}
+	return lo, hi
+}
+
 // FixedValue ===========================================
 
 type FixedValue struct {
@@ -26,13 +54,17 @@ func NewFixedValue(value float64) *FixedValue {
 	return &FixedValue{value}
 }
 
-func (self *FixedValue) Update(t float64) {
+func (self *FixedValue) Update(t0 float64, t1 float64) {
 }
 
-func (self *FixedValue) Get() float64 {
+func (self *FixedValue) At(t float64) float64 {
 	return self.value
 }
 
+func (self *FixedValue) Range() (float64, float64) {
+	return self.value, self.value
+}
+
 func (self *FixedValue) Clone(initialValue float64) AnimatedValue {
 	return NewFixedValue(self.value)
 }
@@ -40,22 +72,29 @@ func (self *FixedValue) Clone(initialValue float64) AnimatedValue {
 // SinValue ===========================================
 
 type SinValue struct {
-	value        float64
+	min          float64
+	max          float64
 	initialValue float64
 	scale        float64
 	speed        float64
 }
 
 func NewSinValue(initialValue float64, scale float64, speed float64) *SinValue {
-	return &SinValue{0.0, initialValue, scale, speed}
+	return &SinValue{0.0, 0.0, initialValue, scale, speed}
 }
 
-func (self *SinValue) Update(t float64) {
-	self.value = self.initialValue + self.scale*math.Sin(self.speed*math.Pi*t/180.0)
+func (self *SinValue) Update(t0 float64, t1 float64) {
+	lo, hi := sinRange(self.speed*math.Pi*t0/180.0, self.speed*math.Pi*t1/180.0)
+	self.min = self.initialValue + math.Min(self.scale*lo, self.scale*hi)
+	self.max = self.initialValue + math.Max(self.scale*lo, self.scale*hi)
 }
 
-func (self *SinValue) Get() float64 {
-	return self.value
+func (self *SinValue) At(t float64) float64 {
+	return self.initialValue + self.scale*math.Sin(self.speed*math.Pi*t/180.0)
+}
+
+func (self *SinValue) Range() (float64, float64) {
+	return self.min, self.max
 }
 
 func (self *SinValue) Clone(initialValue float64) AnimatedValue {
@@ -72,13 +111,17 @@ func NewFixedVector3(x float64, y float64, z float64) *FixedVector3 {
 	return &FixedVector3{Vector3{x, y, z}}
 }
 
-func (self *FixedVector3) Update(t float64) {
+func (self *FixedVector3) Update(t0 float64, t1 float64) {
 }
 
-func (self *FixedVector3) Get() *Vector3 {
+func (self *FixedVector3) At(t float64) *Vector3 {
 	return &self.value
 }
 
+func (self *FixedVector3) Bounds() *AABB {
+	return &AABB{self.value, self.value}
+}
+
 func (self *FixedVector3) Clone() AnimatedVector {
 	return NewFixedVector3(self.value.X, self.value.Y, self.value.Z)
 }
@@ -86,24 +129,41 @@ func (self *FixedVector3) Clone() AnimatedVector {
 // CircularPositionVector3 ===================================
 
 type CircularYPositionVector3 struct {
-	value  Vector3
+	bounds AABB
 	center Vector3
 	radius float64
 	speed  float64
 }
 
 func NewCircularYPositionVector3(cx float64, cy float64, cz float64, radius float64, speed float64) *CircularYPositionVector3 {
-	return &CircularYPositionVector3{Vector3{}, Vector3{cx, cy, cz}, radius, speed}
-}
-
-func (self *CircularYPositionVector3) Update(t float64) {
-	self.value.X = self.center.X + math.Cos(self.speed*math.Pi*t/180.0)*self.radius
-	self.value.Y = self.center.Y
-	self.value.Z = self.center.Z + math.Sin(self.speed*math.Pi*t/180.0)*self.radius
-}
-
-func (self *CircularYPositionVector3) Get() *Vector3 {
-	return &self.value
+	return &CircularYPositionVector3{AABB{}, Vector3{cx, cy, cz}, radius, speed}
+}
+
+func (self *CircularYPositionVector3) Update(t0 float64, t1 float64) {
+	a0 := self.speed * math.Pi * t0 / 180.0
+	a1 := self.speed * math.Pi * t1 / 180.0
+	// cos(a) = sin(a + pi/2)
+	cosLo, cosHi := sinRange(a0+math.Pi/2.0, a1+math.Pi/2.0)
+	sinLo, sinHi := sinRange(a0, a1)
+	r := math.Abs(self.radius)
+	if self.radius < 0.0 {
+		cosLo, cosHi = -cosHi, -cosLo
+		sinLo, sinHi = -sinHi, -sinLo
+	}
+	self.bounds = AABB{
+		Vector3{self.center.X + cosLo*r, self.center.Y, self.center.Z + sinLo*r},
+		Vector3{self.center.X + cosHi*r, self.center.Y, self.center.Z + sinHi*r}}
+}
+
+func (self *CircularYPositionVector3) At(t float64) *Vector3 {
+	angle := self.speed * math.Pi * t / 180.0
+	return NewVector(self.center.X+math.Cos(angle)*self.radius,
+		self.center.Y,
+		self.center.Z+math.Sin(angle)*self.radius)
+}
+
+func (self *CircularYPositionVector3) Bounds() *AABB {
+	return &self.bounds
 }
 
 func (self *CircularYPositionVector3) Clone() AnimatedVector {
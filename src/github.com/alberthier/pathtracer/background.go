@@ -0,0 +1,69 @@
+package pathtracer
+
+import (
+	"math"
+)
+
+type Background interface {
+	Color(ray *Ray) *Color
+}
+
+// Solid color =======================================================
+
+type SolidBackground struct {
+	color *Color
+}
+
+func NewSolidBackground(color *Color) *SolidBackground {
+	return &SolidBackground{color}
+}
+
+func (self *SolidBackground) Color(ray *Ray) *Color {
+	return self.color
+}
+
+// Vertical gradient =======================================================
+
+type GradientBackground struct {
+	bottom *Color
+	top    *Color
+}
+
+func NewGradientBackground(bottom *Color, top *Color) *GradientBackground {
+	return &GradientBackground{bottom, top}
+}
+
+func (self *GradientBackground) Color(ray *Ray) *Color {
+	udir := ray.Direction.Unit()
+	t := 0.5 * (udir.Y + 1.0)
+	return NewColor((1-t)*self.bottom.R+t*self.top.R,
+		(1-t)*self.bottom.G+t*self.top.G,
+		(1-t)*self.bottom.B+t*self.top.B)
+}
+
+// Equirectangular environment map =======================================================
+
+type EnvironmentMap struct {
+	image     *FloatImage
+	intensity float64
+	rotation  float64
+}
+
+// Rotation is in degrees around the Y axis
+func NewEnvironmentMap(image *FloatImage, intensity float64, rotation float64) *EnvironmentMap {
+	return &EnvironmentMap{image, intensity, rotation * math.Pi / 180.0}
+}
+
+func (self *EnvironmentMap) Color(ray *Ray) *Color {
+	udir := ray.Direction.Unit()
+	phi := math.Atan2(udir.X, -udir.Z) + self.rotation
+	theta := math.Acos(math.Max(-1.0, math.Min(1.0, udir.Y)))
+	u := phi / (2.0 * math.Pi)
+	u -= math.Floor(u)
+	v := theta / math.Pi
+
+	// Wrapping horizontally around the Y axis, clamped at the poles
+	color := sampleBilinear(self.image, u*float64(self.image.Width)-0.5, v*float64(self.image.Height)-0.5, WrapRepeat, WrapClamp)
+	color.MultiplyAll(self.intensity)
+	return color
+}
@@ -0,0 +1,285 @@
+package pathtracer
+
+import (
+	"math"
+)
+
+// Axis aligned bounding box =====================================================================
+
+type AABB struct {
+	Min Vector3
+	Max Vector3
+}
+
+func NewAABB(min *Vector3, max *Vector3) *AABB {
+	return &AABB{*min, *max}
+}
+
+func emptyAABB() *AABB {
+	inf := math.Inf(1)
+	return &AABB{Vector3{inf, inf, inf}, Vector3{-inf, -inf, -inf}}
+}
+
+func (self *AABB) Union(other *AABB) *AABB {
+	return &AABB{
+		Vector3{math.Min(self.Min.X, other.Min.X), math.Min(self.Min.Y, other.Min.Y), math.Min(self.Min.Z, other.Min.Z)},
+		Vector3{math.Max(self.Max.X, other.Max.X), math.Max(self.Max.Y, other.Max.Y), math.Max(self.Max.Z, other.Max.Z)}}
+}
+
+func (self *AABB) Extend(point *Vector3) *AABB {
+	return self.Union(&AABB{*point, *point})
+}
+
+// Pad avoids flat boxes, e.g. around axis aligned triangles
+func (self *AABB) Pad(delta float64) *AABB {
+	padded := *self
+	if padded.Max.X-padded.Min.X < delta {
+		padded.Min.X -= delta
+		padded.Max.X += delta
+	}
+	if padded.Max.Y-padded.Min.Y < delta {
+		padded.Min.Y -= delta
+		padded.Max.Y += delta
+	}
+	if padded.Max.Z-padded.Min.Z < delta {
+		padded.Min.Z -= delta
+		padded.Max.Z += delta
+	}
+	return &padded
+}
+
+func (self *AABB) Centroid() *Vector3 {
+	return self.Min.Add(&self.Max).Scale(0.5)
+}
+
+func (self *AABB) SurfaceArea() float64 {
+	d := self.Max.Subtract(&self.Min)
+	if d.X < 0.0 || d.Y < 0.0 || d.Z < 0.0 {
+		return 0.0
+	}
+	return 2.0 * (d.X*d.Y + d.Y*d.Z + d.Z*d.X)
+}
+
+func (self *AABB) HitBy(ray *Ray, tmin float64, tmax float64) bool {
+	invDir := Vector3{1.0 / ray.Direction.X, 1.0 / ray.Direction.Y, 1.0 / ray.Direction.Z}
+	return self.hitBySlabs(ray.Origin, &invDir, tmin, tmax)
+}
+
+func (self *AABB) hitBySlabs(origin *Vector3, invDir *Vector3, tmin float64, tmax float64) bool {
+	_, _, ok := self.clipSlabs(origin, invDir, tmin, tmax)
+	return ok
+}
+
+// clipSlabs restricts [tmin, tmax] to the part of the ray inside the box
+func (self *AABB) clipSlabs(origin *Vector3, invDir *Vector3, tmin float64, tmax float64) (float64, float64, bool) {
+	t0 := (self.Min.X - origin.X) * invDir.X
+	t1 := (self.Max.X - origin.X) * invDir.X
+	if invDir.X < 0.0 {
+		t0, t1 = t1, t0
+	}
+	tmin = math.Max(tmin, t0)
+	tmax = math.Min(tmax, t1)
+	t0 = (self.Min.Y - origin.Y) * invDir.Y
+	t1 = (self.Max.Y - origin.Y) * invDir.Y
+	if invDir.Y < 0.0 {
+		t0, t1 = t1, t0
+	}
+	tmin = math.Max(tmin, t0)
+	tmax = math.Min(tmax, t1)
+	t0 = (self.Min.Z - origin.Z) * invDir.Z
+	t1 = (self.Max.Z - origin.Z) * invDir.Z
+	if invDir.Z < 0.0 {
+		t0, t1 = t1, t0
+	}
+	tmin = math.Max(tmin, t0)
+	tmax = math.Min(tmax, t1)
+	return tmin, tmax, tmin <= tmax
+}
+
+func axisValue(v *Vector3, axis int) float64 {
+	switch axis {
+	case 0:
+		return v.X
+	case 1:
+		return v.Y
+	}
+	return v.Z
+}
+
+// Bounding volume hierarchy =====================================================================
+
+const bvhBinCount = 12
+const bvhMaxLeafSize = 4
+
+type bvhNode struct {
+	box   AABB
+	left  int // Index of the first object for leaves, of the left child otherwise
+	right int // Object count for leaves, index of the right child otherwise
+	leaf  bool
+}
+
+// BVH is a surface area heuristic bounding volume hierarchy. Objects without
+// bounding box, like infinite planes, are tested one by one.
+type BVH struct {
+	objects   []SceneObject
+	boxes     []*AABB
+	unbounded []SceneObject
+	nodes     []bvhNode
+}
+
+func NewBVH(objects []SceneObject) *BVH {
+	self := &BVH{}
+	for _, obj := range objects {
+		box := objectBoundingBox(obj)
+		if box == nil {
+			self.unbounded = append(self.unbounded, obj)
+		} else {
+			self.objects = append(self.objects, obj)
+			self.boxes = append(self.boxes, box)
+		}
+	}
+	if len(self.objects) != 0 {
+		self.build(0, len(self.objects))
+	}
+	return self
+}
+
+func (self *BVH) boundsOf(start int, end int) (*AABB, *AABB) {
+	bounds := emptyAABB()
+	centroids := emptyAABB()
+	for i := start; i < end; i++ {
+		bounds = bounds.Union(self.boxes[i])
+		centroids = centroids.Extend(self.boxes[i].Centroid())
+	}
+	return bounds, centroids
+}
+
+// Recursively builds the subtree for objects[start:end] and returns its node index
+func (self *BVH) build(start int, end int) int {
+	bounds, centroids := self.boundsOf(start, end)
+	index := len(self.nodes)
+	self.nodes = append(self.nodes, bvhNode{box: *bounds, left: start, right: end - start, leaf: true})
+	count := end - start
+	if count <= 1 {
+		return index
+	}
+
+	extent := centroids.Max.Subtract(&centroids.Min)
+	axis := 0
+	if extent.Y > extent.X && extent.Y >= extent.Z {
+		axis = 1
+	} else if extent.Z > extent.X && extent.Z > extent.Y {
+		axis = 2
+	}
+	axisMin := axisValue(&centroids.Min, axis)
+	axisExtent := axisValue(extent, axis)
+	if axisExtent <= 0.0 {
+		// All centroids are at the same place, no split can help
+		return index
+	}
+
+	binOf := func(i int) int {
+		bin := int(bvhBinCount * (axisValue(self.boxes[i].Centroid(), axis) - axisMin) / axisExtent)
+		if bin >= bvhBinCount {
+			bin = bvhBinCount - 1
+		}
+		return bin
+	}
+
+	var binCounts [bvhBinCount]int
+	var binBoxes [bvhBinCount]*AABB
+	for i := range binBoxes {
+		binBoxes[i] = emptyAABB()
+	}
+	for i := start; i < end; i++ {
+		bin := binOf(i)
+		binCounts[bin]++
+		binBoxes[bin] = binBoxes[bin].Union(self.boxes[i])
+	}
+
+	// Evaluate the SAH cost of splitting after each bin
+	bestCost := math.Inf(1)
+	bestSplit := -1
+	parentArea := bounds.SurfaceArea()
+	for split := 0; split < bvhBinCount-1; split++ {
+		leftBox, rightBox := emptyAABB(), emptyAABB()
+		leftCount, rightCount := 0, 0
+		for i := 0; i <= split; i++ {
+			leftBox = leftBox.Union(binBoxes[i])
+			leftCount += binCounts[i]
+		}
+		for i := split + 1; i < bvhBinCount; i++ {
+			rightBox = rightBox.Union(binBoxes[i])
+			rightCount += binCounts[i]
+		}
+		if leftCount == 0 || rightCount == 0 {
+			continue
+		}
+		cost := 0.125 + (leftBox.SurfaceArea()*float64(leftCount)+rightBox.SurfaceArea()*float64(rightCount))/parentArea
+		if cost < bestCost {
+			bestCost = cost
+			bestSplit = split
+		}
+	}
+	if bestSplit < 0 || (count <= bvhMaxLeafSize && bestCost >= float64(count)) {
+		return index
+	}
+
+	// Partition objects around the split
+	mid := start
+	for i := start; i < end; i++ {
+		if binOf(i) <= bestSplit {
+			self.objects[i], self.objects[mid] = self.objects[mid], self.objects[i]
+			self.boxes[i], self.boxes[mid] = self.boxes[mid], self.boxes[i]
+			mid++
+		}
+	}
+
+	left := self.build(start, mid)
+	right := self.build(mid, end)
+	self.nodes[index].left = left
+	self.nodes[index].right = right
+	self.nodes[index].leaf = false
+	return index
+}
+
+func (self *BVH) HitBy(ray *Ray, tmin float64, tmax float64, record *HitRecord) bool {
+	hitSomething := false
+	for _, obj := range self.unbounded {
+		if hitObject(obj, ray, tmin, tmax, record) {
+			hitSomething = true
+			tmax = record.t
+		}
+	}
+	if len(self.nodes) == 0 {
+		return hitSomething
+	}
+
+	invDir := Vector3{1.0 / ray.Direction.X, 1.0 / ray.Direction.Y, 1.0 / ray.Direction.Z}
+	stack := make([]int, 1, 64)
+	for len(stack) > 0 {
+		node := &self.nodes[stack[len(stack)-1]]
+		stack = stack[:len(stack)-1]
+		if !node.box.hitBySlabs(ray.Origin, &invDir, tmin, tmax) {
+			continue
+		}
+		if node.leaf {
+			for i := node.left; i < node.left+node.right; i++ {
+				if hitObject(self.objects[i], ray, tmin, tmax, record) {
+					hitSomething = true
+					tmax = record.t
+				}
+			}
+		} else {
+			stack = append(stack, node.right, node.left)
+		}
+	}
+	return hitSomething
+}
+
+func (self *BVH) BoundingBox() *AABB {
+	if len(self.unbounded) != 0 || len(self.nodes) == 0 {
+		return nil
+	}
+	return &self.nodes[0].box
+}
@@ -6,13 +6,23 @@ import (
 )
 
 type Camera struct {
-	position    AnimatedVector
-	lookAt      AnimatedVector
-	up          AnimatedVector
-	vertFov     AnimatedValue
-	aperture    AnimatedValue
-	aspectRatio float64
+	position     AnimatedVector
+	lookAt       AnimatedVector
+	up           AnimatedVector
+	vertFov      AnimatedValue
+	aperture     AnimatedValue
+	aspectRatio  float64
+	shutterOpen  float64
+	shutterClose float64
 
+	t0    float64
+	t1    float64
+	frame *cameraFrame
+}
+
+// cameraFrame is the camera placement at a given time
+type cameraFrame struct {
+	position        *Vector3
 	lowerLeftCorner *Vector3
 	horizontal      *Vector3
 	vertical        *Vector3
@@ -22,7 +32,9 @@ type Camera struct {
 	w               *Vector3
 }
 
-func NewCamera(position AnimatedVector, lookAt AnimatedVector, up AnimatedVector, vertFov AnimatedValue, aspectRatio float64, aperture AnimatedValue) *Camera {
+// The shutter opens and closes at the given offsets from the frame time.
+// Rays are spread over this interval, which blurs moving objects.
+func NewCamera(position AnimatedVector, lookAt AnimatedVector, up AnimatedVector, vertFov AnimatedValue, aspectRatio float64, aperture AnimatedValue, shutterOpen float64, shutterClose float64) *Camera {
 	self := &Camera{}
 	self.position = position
 	self.lookAt = lookAt
@@ -30,29 +42,47 @@ func NewCamera(position AnimatedVector, lookAt AnimatedVector, up AnimatedVector
 	self.vertFov = vertFov
 	self.aperture = aperture
 	self.aspectRatio = aspectRatio
+	self.shutterOpen = shutterOpen
+	self.shutterClose = math.Max(shutterOpen, shutterClose)
 	return self
 }
 
-func (self *Camera) Update(t float64) {
-	self.position.Update(t)
-	self.lookAt.Update(t)
-	self.up.Update(t)
-	self.vertFov.Update(t)
-	self.aperture.Update(t)
+// ShutterInterval returns the times during which the frame at time t is exposed
+func (self *Camera) ShutterInterval(t float64) (float64, float64) {
+	return t + self.shutterOpen, t + self.shutterClose
+}
 
-	theta := self.vertFov.Get() * math.Pi / 180.0
-	focusDistance := self.position.Get().Subtract(self.lookAt.Get()).Length()
+func (self *Camera) Update(t0 float64, t1 float64) {
+	self.position.Update(t0, t1)
+	self.lookAt.Update(t0, t1)
+	self.up.Update(t0, t1)
+	self.vertFov.Update(t0, t1)
+	self.aperture.Update(t0, t1)
+	self.t0 = t0
+	self.t1 = t1
+	self.frame = self.frameAt(t0)
+}
+
+func (self *Camera) frameAt(t float64) *cameraFrame {
+	frame := &cameraFrame{}
+	position := self.position.At(t)
+	lookAt := self.lookAt.At(t)
+
+	theta := self.vertFov.At(t) * math.Pi / 180.0
+	focusDistance := position.Subtract(lookAt).Length()
 	lHeight := math.Tan(theta/2.0) * focusDistance
 	lWidth := self.aspectRatio * lHeight
 
-	self.w = self.position.Get().Subtract(self.lookAt.Get()).Unit()
-	self.u = self.up.Get().Cross(self.w).Unit()
-	self.v = self.w.Cross(self.u)
+	frame.position = position
+	frame.w = position.Subtract(lookAt).Unit()
+	frame.u = self.up.At(t).Cross(frame.w).Unit()
+	frame.v = frame.w.Cross(frame.u)
 
-	self.lensRadius = self.aperture.Get() / 2.0
-	self.lowerLeftCorner = self.position.Get().Subtract(self.u.Scale(lWidth)).Subtract(self.v.Scale(lHeight)).Subtract(self.w.Scale(focusDistance))
-	self.horizontal = self.u.Scale(2.0 * lWidth)
-	self.vertical = self.v.Scale(2.0 * lHeight)
+	frame.lensRadius = self.aperture.At(t) / 2.0
+	frame.lowerLeftCorner = position.Subtract(frame.u.Scale(lWidth)).Subtract(frame.v.Scale(lHeight)).Subtract(frame.w.Scale(focusDistance))
+	frame.horizontal = frame.u.Scale(2.0 * lWidth)
+	frame.vertical = frame.v.Scale(2.0 * lHeight)
+	return frame
 }
 
 func randomVectorInUnitDisk(rng *rand.Rand) *Vector3 {
@@ -65,8 +95,15 @@ func randomVectorInUnitDisk(rng *rand.Rand) *Vector3 {
 }
 
 func (self *Camera) GetRay(rng *rand.Rand, s float64, t float64) *Ray {
-	rnd := randomVectorInUnitDisk(rng).Scale(self.lensRadius)
-	offset := self.u.Scale(rnd.X).Add(self.v.Scale(rnd.Y))
-	return NewRay(self.position.Get().Add(offset),
-		self.lowerLeftCorner.Add(self.horizontal.Scale(s)).Add(self.vertical.Scale(t)).Subtract(self.position.Get()).Subtract(offset))
+	time := self.t0
+	frame := self.frame
+	if self.t1 > self.t0 {
+		time += rng.Float64() * (self.t1 - self.t0)
+		frame = self.frameAt(time)
+	}
+	rnd := randomVectorInUnitDisk(rng).Scale(frame.lensRadius)
+	offset := frame.u.Scale(rnd.X).Add(frame.v.Scale(rnd.Y))
+	return NewRay(frame.position.Add(offset),
+		frame.lowerLeftCorner.Add(frame.horizontal.Scale(s)).Add(frame.vertical.Scale(t)).Subtract(frame.position).Subtract(offset),
+		time)
 }
@@ -0,0 +1,265 @@
+package pathtracer
+
+import (
+	"math"
+	"sort"
+)
+
+type CsgOperation int
+
+const (
+	CsgUnion CsgOperation = iota
+	CsgIntersection
+	CsgDifference
+)
+
+func NewCsgOperation(name string) (CsgOperation, bool) {
+	switch name {
+	case "union":
+		return CsgUnion, true
+	case "intersection":
+		return CsgIntersection, true
+	case "difference":
+		return CsgDifference, true
+	}
+	return CsgUnion, false
+}
+
+func (self CsgOperation) inside(inLeft bool, inRight bool) bool {
+	switch self {
+	case CsgIntersection:
+		return inLeft && inRight
+	case CsgDifference:
+		return inLeft && !inRight
+	}
+	return inLeft || inRight
+}
+
+// Span is the part of a ray lying inside a solid, between the surface where
+// the ray enters and the surface where it exits
+type Span struct {
+	Enter HitRecord
+	Exit  HitRecord
+}
+
+// Solid objects report every span along a ray instead of the nearest hit only
+type Solid interface {
+	SceneObject
+	Spans(ray *Ray) []Span
+}
+
+// Maximum number of surfaces crossed when searching the spans of an object
+const maxSpanHits = 64
+
+// objectSpans returns the world space spans of an object along the whole ray
+// line. Objects which are not solids are walked hit after hit and must be
+// closed, with outward facing normals.
+func objectSpans(obj SceneObject, ray *Ray) []Span {
+	solid, ok := obj.(Solid)
+	if !ok {
+		return walkSpans(obj, ray)
+	}
+	transform := obj.GetTransform()
+	if transform == nil {
+		return solid.Spans(ray)
+	}
+	spans := solid.Spans(transform.RayToObject(ray))
+	for i := range spans {
+		for _, record := range [2]*HitRecord{&spans[i].Enter, &spans[i].Exit} {
+			record.point = ray.PointAt(record.t)
+			record.normal = transform.NormalToWorld(record.normal)
+		}
+	}
+	return spans
+}
+
+// isClosed tells whether an object bounds a volume, so that rays alternately
+// enter and exit it. Meshes are closed when each edge is shared by exactly two
+// faces, signed distance fields when they are bounded.
+func isClosed(obj SceneObject) bool {
+	switch o := obj.(type) {
+	case *Sphere, *Box, *Torus, *Csg:
+		return true
+	case *SdfObject:
+		return o.BoundingBox() != nil
+	case *Cylinder:
+		return o.Capped
+	case *Cone:
+		return o.Capped
+	case *Instance:
+		return isClosed(o.Object)
+	case *Group:
+		for _, child := range o.Objects {
+			if !isClosed(child) {
+				return false
+			}
+		}
+		return len(o.Objects) != 0
+	case *Mesh:
+		// Vertices are compared by position, OBJ files split them by normal
+		// and UV
+		edges := make(map[[2]Vector3]int)
+		for _, face := range o.Faces {
+			for i := 0; i < 3; i++ {
+				a, b := *o.Vertices[face.Vertices[i]], *o.Vertices[face.Vertices[(i+1)%3]]
+				if b.X < a.X || (b.X == a.X && (b.Y < a.Y || (b.Y == a.Y && b.Z < a.Z))) {
+					a, b = b, a
+				}
+				edges[[2]Vector3{a, b}]++
+			}
+		}
+		for _, count := range edges {
+			if count != 2 {
+				return false
+			}
+		}
+		return len(edges) != 0
+	}
+	return false
+}
+
+func walkSpans(obj SceneObject, ray *Ray) []Span {
+	spans := []Span{}
+	depth := 0
+	var enter HitRecord
+	var record HitRecord
+	// The walk is limited to the part of the ray line inside the bounding
+	// box, far from the origin the steps between hits would lose precision
+	tmin, tmax := -math.MaxFloat64, math.MaxFloat64
+	if box := objectBoundingBox(obj); box != nil {
+		invDir := Vector3{1.0 / ray.Direction.X, 1.0 / ray.Direction.Y, 1.0 / ray.Direction.Z}
+		var ok bool
+		if tmin, tmax, ok = box.clipSlabs(ray.Origin, &invDir, tmin, tmax); !ok {
+			return spans
+		}
+		// Surfaces may lie on the box
+		tmin -= 1e-6 * math.Max(1.0, math.Abs(tmin))
+		tmax += 1e-6 * math.Max(1.0, math.Abs(tmax))
+	}
+	for i := 0; i < maxSpanHits && hitObject(obj, ray, tmin, tmax, &record); i++ {
+		if record.normal.Dot(ray.Direction) < 0.0 {
+			if depth == 0 {
+				enter = record
+			}
+			depth++
+		} else if depth > 0 {
+			depth--
+			if depth == 0 {
+				spans = append(spans, Span{enter, record})
+			}
+		}
+		tmin = record.t + 1e-9*math.Max(1.0, math.Abs(record.t))
+	}
+	return spans
+}
+
+// Csg =====================================================================
+
+// Csg combines two solids. Surfaces keep the material of the child they come
+// from, unless the node has its own material.
+type Csg struct {
+	ObjectBase
+	Operation CsgOperation
+	Left      SceneObject
+	Right     SceneObject
+	Material  Material
+}
+
+func NewCsg(operation CsgOperation, left SceneObject, right SceneObject, material Material) *Csg {
+	return &Csg{Operation: operation, Left: left, Right: right, Material: material}
+}
+
+type csgEvent struct {
+	record *HitRecord
+	right  bool
+	enter  bool
+}
+
+func (self *Csg) Spans(ray *Ray) []Span {
+	left := objectSpans(self.Left, ray)
+	right := objectSpans(self.Right, ray)
+	events := make([]csgEvent, 0, 2*(len(left)+len(right)))
+	for i := range left {
+		events = append(events, csgEvent{&left[i].Enter, false, true}, csgEvent{&left[i].Exit, false, false})
+	}
+	for i := range right {
+		events = append(events, csgEvent{&right[i].Enter, true, true}, csgEvent{&right[i].Exit, true, false})
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].record.t < events[j].record.t
+	})
+
+	spans := []Span{}
+	inLeft, inRight, inside := false, false, false
+	var current Span
+	for _, event := range events {
+		if event.right {
+			inRight = event.enter
+		} else {
+			inLeft = event.enter
+		}
+		if self.Operation.inside(inLeft, inRight) == inside {
+			continue
+		}
+		inside = !inside
+		record := *event.record
+		if event.right && self.Operation == CsgDifference {
+			// The subtracted solid is seen from its inside
+			record.normal = record.normal.Scale(-1.0)
+		}
+		if self.Material != nil {
+			record.object = self
+		}
+		if inside {
+			current.Enter = record
+		} else {
+			current.Exit = record
+			spans = append(spans, current)
+		}
+	}
+	return spans
+}
+
+func (self *Csg) HitBy(ray *Ray, tmin float64, tmax float64, record *HitRecord) bool {
+	for _, span := range self.Spans(ray) {
+		for _, candidate := range [2]*HitRecord{&span.Enter, &span.Exit} {
+			if tmin < candidate.t && candidate.t < tmax {
+				*record = *candidate
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (self *Csg) GetMaterial() Material {
+	return self.Material
+}
+
+func (self *Csg) Update(t0 float64, t1 float64) {
+	self.Left.Update(t0, t1)
+	self.Right.Update(t0, t1)
+}
+
+func (self *Csg) BoundingBox() *AABB {
+	left := objectBoundingBox(self.Left)
+	right := objectBoundingBox(self.Right)
+	switch self.Operation {
+	case CsgIntersection:
+		if left == nil {
+			return right
+		}
+		if right == nil {
+			return left
+		}
+		return &AABB{
+			Vector3{math.Max(left.Min.X, right.Min.X), math.Max(left.Min.Y, right.Min.Y), math.Max(left.Min.Z, right.Min.Z)},
+			Vector3{math.Min(left.Max.X, right.Max.X), math.Min(left.Max.Y, right.Max.Y), math.Min(left.Max.Z, right.Max.Z)}}
+	case CsgDifference:
+		return left
+	}
+	if left == nil || right == nil {
+		return nil
+	}
+	return left.Union(right)
+}
@@ -0,0 +1,147 @@
+package pathtracer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// OpenEXR writer =====================================================================
+
+type EXRCompression byte
+
+const (
+	EXRNoCompression  EXRCompression = 0
+	EXRZipCompression EXRCompression = 3
+)
+
+func NewEXRCompression(name string) (EXRCompression, bool) {
+	switch name {
+	case "none":
+		return EXRNoCompression, true
+	case "zip":
+		return EXRZipCompression, true
+	}
+	return EXRZipCompression, false
+}
+
+func (self EXRCompression) linesPerBlock() int {
+	if self == EXRZipCompression {
+		return 16
+	}
+	return 1
+}
+
+func writeEXRAttribute(buffer *bytes.Buffer, name string, typ string, value []byte) {
+	buffer.WriteString(name)
+	buffer.WriteByte(0)
+	buffer.WriteString(typ)
+	buffer.WriteByte(0)
+	binary.Write(buffer, binary.LittleEndian, int32(len(value)))
+	buffer.Write(value)
+}
+
+func exrHeader(width int, height int, compression EXRCompression) []byte {
+	buffer := &bytes.Buffer{}
+	// Magic number and version 2, single part scanline file
+	buffer.Write([]byte{0x76, 0x2f, 0x31, 0x01, 2, 0, 0, 0})
+
+	channels := &bytes.Buffer{}
+	// Channels must be sorted by name, all stored as 32 bits floats
+	for _, name := range []string{"B", "G", "R"} {
+		channels.WriteString(name)
+		channels.WriteByte(0)
+		binary.Write(channels, binary.LittleEndian, []int32{2, 0, 1, 1})
+	}
+	channels.WriteByte(0)
+	writeEXRAttribute(buffer, "channels", "chlist", channels.Bytes())
+
+	writeEXRAttribute(buffer, "compression", "compression", []byte{byte(compression)})
+
+	window := &bytes.Buffer{}
+	binary.Write(window, binary.LittleEndian, []int32{0, 0, int32(width - 1), int32(height - 1)})
+	writeEXRAttribute(buffer, "dataWindow", "box2i", window.Bytes())
+	writeEXRAttribute(buffer, "displayWindow", "box2i", window.Bytes())
+
+	writeEXRAttribute(buffer, "lineOrder", "lineOrder", []byte{0})
+
+	float := make([]byte, 4)
+	binary.LittleEndian.PutUint32(float, math.Float32bits(1.0))
+	writeEXRAttribute(buffer, "pixelAspectRatio", "float", float)
+	writeEXRAttribute(buffer, "screenWindowCenter", "v2f", make([]byte, 8))
+	writeEXRAttribute(buffer, "screenWindowWidth", "float", float)
+
+	buffer.WriteByte(0)
+	return buffer.Bytes()
+}
+
+// Applies the OpenEXR ZIP preprocessing (byte interleaving and delta
+// predictor) and deflates the data
+func exrZip(data []byte) []byte {
+	tmp := make([]byte, len(data))
+	half := (len(data) + 1) / 2
+	for i := range data {
+		if i%2 == 0 {
+			tmp[i/2] = data[i]
+		} else {
+			tmp[half+i/2] = data[i]
+		}
+	}
+	previous := int(tmp[0])
+	for i := 1; i < len(tmp); i++ {
+		current := int(tmp[i])
+		tmp[i] = byte(current - previous + 128 + 256)
+		previous = current
+	}
+	compressed := &bytes.Buffer{}
+	writer := zlib.NewWriter(compressed)
+	writer.Write(tmp)
+	writer.Close()
+	return compressed.Bytes()
+}
+
+// WriteEXR writes the image as a scanline OpenEXR file with float channels
+func (self *FloatImage) WriteEXR(w io.Writer, compression EXRCompression) error {
+	header := exrHeader(self.Width, self.Height, compression)
+	linesPerBlock := compression.linesPerBlock()
+	blockCount := (self.Height + linesPerBlock - 1) / linesPerBlock
+
+	// Build all blocks first, the offset table precedes them
+	blocks := make([][]byte, blockCount)
+	raw := &bytes.Buffer{}
+	for block := 0; block < blockCount; block++ {
+		raw.Reset()
+		firstLine := block * linesPerBlock
+		for y := firstLine; y < firstLine+linesPerBlock && y < self.Height; y++ {
+			for _, channel := range []int{2, 1, 0} {
+				for x := 0; x < self.Width; x++ {
+					binary.Write(raw, binary.LittleEndian, self.Pix[3*(y*self.Width+x)+channel])
+				}
+			}
+		}
+		data := raw.Bytes()
+		if compression == EXRZipCompression {
+			// Uncompressed data is kept when compression doesn't help
+			if compressed := exrZip(data); len(compressed) < len(data) {
+				data = compressed
+			}
+		}
+		blocks[block] = append([]byte{}, data...)
+	}
+
+	writer := bufio.NewWriter(w)
+	writer.Write(header)
+	offset := uint64(len(header) + 8*blockCount)
+	for _, block := range blocks {
+		binary.Write(writer, binary.LittleEndian, offset)
+		offset += uint64(8 + len(block))
+	}
+	for i, block := range blocks {
+		binary.Write(writer, binary.LittleEndian, []int32{int32(i * linesPerBlock), int32(len(block))})
+		writer.Write(block)
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,71 @@
+package pathtracer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"testing"
+)
+
+// Inverse of exrZip, as done by OpenEXR readers
+func exrUnzip(t *testing.T, compressed []byte) []byte {
+	reader, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(tmp); i++ {
+		tmp[i] = byte(int(tmp[i-1]) + int(tmp[i]) - 128)
+	}
+	data := make([]byte, len(tmp))
+	half := (len(tmp) + 1) / 2
+	for i := range data {
+		if i%2 == 0 {
+			data[i] = tmp[i/2]
+		} else {
+			data[i] = tmp[half+i/2]
+		}
+	}
+	return data
+}
+
+func TestEXRZipRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"single byte", []byte{42}},
+		{"odd length", []byte{1, 2, 3, 4, 5}},
+		{"wrapping deltas", []byte{0, 255, 0, 255, 128, 1, 254}},
+		{"ramp", func() []byte {
+			data := make([]byte, 1000)
+			for i := range data {
+				data[i] = byte(i * 7)
+			}
+			return data
+		}()},
+	}
+	for _, test := range tests {
+		if got := exrUnzip(t, exrZip(test.data)); !bytes.Equal(got, test.data) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.data)
+		}
+	}
+}
+
+func TestEXRHeader(t *testing.T) {
+	img := NewFloatImage(4, 20)
+	buffer := &bytes.Buffer{}
+	if err := img.WriteEXR(buffer, EXRZipCompression); err != nil {
+		t.Fatal(err)
+	}
+	data := buffer.Bytes()
+	if !bytes.HasPrefix(data, []byte{0x76, 0x2f, 0x31, 0x01}) {
+		t.Errorf("missing OpenEXR magic number: % x", data[:4])
+	}
+	if !bytes.Contains(data, []byte("dataWindow\x00box2i\x00")) {
+		t.Error("missing dataWindow attribute")
+	}
+}
@@ -0,0 +1,93 @@
+package pathtracer
+
+import (
+	"math"
+)
+
+type ToneMapping int
+
+const (
+	ToneMappingClamp ToneMapping = iota
+	ToneMappingReinhard
+	ToneMappingFilmic
+	ToneMappingACES
+)
+
+func NewToneMapping(name string) (ToneMapping, bool) {
+	switch name {
+	case "clamp":
+		return ToneMappingClamp, true
+	case "reinhard":
+		return ToneMappingReinhard, true
+	case "filmic":
+		return ToneMappingFilmic, true
+	case "aces":
+		return ToneMappingACES, true
+	}
+	return ToneMappingClamp, false
+}
+
+// Film converts linear radiance to display values: exposure, tone mapping and
+// transfer function. A zero gamma selects the sRGB transfer function.
+type Film struct {
+	Exposure    float64
+	ToneMapping ToneMapping
+	Gamma       float64
+}
+
+func NewFilm() *Film {
+	return &Film{0.0, ToneMappingClamp, 0.0}
+}
+
+func linearToSrgb(value float64) float64 {
+	if value <= 0.0031308 {
+		return 12.92 * value
+	}
+	return 1.055*math.Pow(value, 1.0/2.4) - 0.055
+}
+
+// Uncharted 2 curve by John Hable
+func hable(x float64) float64 {
+	const a, b, c, d, e, f = 0.15, 0.50, 0.10, 0.20, 0.02, 0.30
+	return (x*(a*x+c*b)+d*e)/(x*(a*x+b)+d*f) - e/f
+}
+
+func filmic(color *Color) *Color {
+	const exposureBias = 2.0
+	whiteScale := 1.0 / hable(11.2)
+	return NewColor(hable(exposureBias*color.R)*whiteScale,
+		hable(exposureBias*color.G)*whiteScale,
+		hable(exposureBias*color.B)*whiteScale)
+}
+
+// ACES reference rendering and output transforms fit by Stephen Hill
+func acesFitted(color *Color) *Color {
+	r := 0.59719*color.R + 0.35458*color.G + 0.04823*color.B
+	g := 0.07600*color.R + 0.90834*color.G + 0.01566*color.B
+	b := 0.02840*color.R + 0.13383*color.G + 0.83777*color.B
+	fit := func(v float64) float64 {
+		return (v*(v+0.0245786) - 0.000090537) / (v*(0.983729*v+0.4329510) + 0.238081)
+	}
+	r, g, b = fit(r), fit(g), fit(b)
+	return NewColor(1.60475*r-0.53108*g-0.07367*b,
+		-0.10208*r+1.10813*g-0.00605*b,
+		-0.00327*r-0.07276*g+1.07602*b)
+}
+
+func (self *Film) ToneMap(color *Color) *Color {
+	scale := math.Pow(2.0, self.Exposure)
+	c := NewColor(math.Max(0.0, color.R*scale), math.Max(0.0, color.G*scale), math.Max(0.0, color.B*scale))
+	switch self.ToneMapping {
+	case ToneMappingReinhard:
+		c = NewColor(c.R/(1.0+c.R), c.G/(1.0+c.G), c.B/(1.0+c.B))
+	case ToneMappingFilmic:
+		c = filmic(c)
+	case ToneMappingACES:
+		c = acesFitted(c)
+	}
+	c = NewColor(clamp(c.R, 0.0, 1.0), clamp(c.G, 0.0, 1.0), clamp(c.B, 0.0, 1.0))
+	if self.Gamma > 0.0 {
+		return NewColor(math.Pow(c.R, 1.0/self.Gamma), math.Pow(c.G, 1.0/self.Gamma), math.Pow(c.B, 1.0/self.Gamma))
+	}
+	return NewColor(linearToSrgb(c.R), linearToSrgb(c.G), linearToSrgb(c.B))
+}
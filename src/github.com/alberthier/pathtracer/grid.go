@@ -0,0 +1,161 @@
+package pathtracer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+)
+
+// DensityGrid =====================================================================
+
+// DensityGrid holds voxel densities over a box, the first index varying along
+// X. Values are cell centered and interpolated trilinearly.
+type DensityGrid struct {
+	Nx      int
+	Ny      int
+	Nz      int
+	Data    []float32
+	Box     AABB
+	maximum float64
+}
+
+func NewDensityGrid(nx int, ny int, nz int, data []float32, box *AABB) *DensityGrid {
+	self := &DensityGrid{nx, ny, nz, data, *box, 0.0}
+	for _, value := range data {
+		self.maximum = math.Max(self.maximum, float64(value))
+	}
+	return self
+}
+
+// LoadDensityGrid reads a Mitsuba .vol file, whose header gives the resolution
+// and the box, or a headerless raw file of float32 or 8 bit values with the
+// given resolution. Raw grids fill the unit box.
+func LoadDensityGrid(filename string, resolution [3]int) (*DensityGrid, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(filename) == ".vol" {
+		return decodeVol(filename, content)
+	}
+	nx, ny, nz := resolution[0], resolution[1], resolution[2]
+	count := nx * ny * nz
+	if count <= 0 {
+		return nil, fmt.Errorf("%s: raw grids need a resolution", filename)
+	}
+	data := make([]float32, count)
+	switch len(content) {
+	case count * 4:
+		for i := range data {
+			data[i] = math.Float32frombits(binary.LittleEndian.Uint32(content[4*i:]))
+		}
+		break
+	case count:
+		for i := range data {
+			data[i] = float32(content[i]) / 255.0
+		}
+		break
+	default:
+		return nil, fmt.Errorf("%s: size doesn't match a %dx%dx%d grid", filename, nx, ny, nz)
+	}
+	return NewDensityGrid(nx, ny, nz, data, NewAABB(NewVector(0.0, 0.0, 0.0), NewVector(1.0, 1.0, 1.0))), nil
+}
+
+func decodeVol(filename string, content []byte) (*DensityGrid, error) {
+	if len(content) < 48 || string(content[0:3]) != "VOL" || content[3] != 3 {
+		return nil, fmt.Errorf("%s: not a version 3 .vol file", filename)
+	}
+	header := func(i int) int {
+		return int(int32(binary.LittleEndian.Uint32(content[4+4*i:])))
+	}
+	if header(0) != 1 {
+		return nil, fmt.Errorf("%s: only float32 .vol files are supported", filename)
+	}
+	nx, ny, nz, channels := header(1), header(2), header(3), header(4)
+	if nx <= 0 || ny <= 0 || nz <= 0 || channels <= 0 {
+		return nil, fmt.Errorf("%s: invalid resolution", filename)
+	}
+	bounds := [6]float64{}
+	for i := range bounds {
+		bounds[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(content[24+4*i:])))
+	}
+	count := nx * ny * nz
+	if len(content) < 48+4*count*channels {
+		return nil, fmt.Errorf("%s: truncated data", filename)
+	}
+	// Only the first channel is used as density
+	data := make([]float32, count)
+	for i := range data {
+		data[i] = math.Float32frombits(binary.LittleEndian.Uint32(content[48+4*i*channels:]))
+	}
+	box := NewAABB(NewVector(bounds[0], bounds[1], bounds[2]), NewVector(bounds[3], bounds[4], bounds[5]))
+	return NewDensityGrid(nx, ny, nz, data, box), nil
+}
+
+// NewNoiseDensityGrid bakes fractal noise into a grid over the box, faded out
+// toward the box border to give a cloud shape
+func NewNoiseDensityGrid(resolution int, box *AABB, scale float64, octaves int, seed int64) *DensityGrid {
+	perlin := NewPerlin(seed)
+	data := make([]float32, resolution*resolution*resolution)
+	i := 0
+	for z := 0; z < resolution; z++ {
+		for y := 0; y < resolution; y++ {
+			for x := 0; x < resolution; x++ {
+				// Cell center in [-1, 1]
+				cx := 2.0*(float64(x)+0.5)/float64(resolution) - 1.0
+				cy := 2.0*(float64(y)+0.5)/float64(resolution) - 1.0
+				cz := 2.0*(float64(z)+0.5)/float64(resolution) - 1.0
+				p := Vector3{cx * scale, cy * scale, cz * scale}
+				density := 0.5 + perlin.FBM(&p, octaves) - (cx*cx + cy*cy + cz*cz)
+				data[i] = float32(math.Max(0.0, math.Min(1.0, density)))
+				i++
+			}
+		}
+	}
+	return NewDensityGrid(resolution, resolution, resolution, data, box)
+}
+
+func (self *DensityGrid) Maximum() float64 {
+	return self.maximum
+}
+
+func clampIndex(i int, n int) int {
+	if i < 0 {
+		return 0
+	}
+	if i >= n {
+		return n - 1
+	}
+	return i
+}
+
+func (self *DensityGrid) voxel(x int, y int, z int) float64 {
+	x = clampIndex(x, self.Nx)
+	y = clampIndex(y, self.Ny)
+	z = clampIndex(z, self.Nz)
+	return float64(self.Data[(z*self.Ny+y)*self.Nx+x])
+}
+
+// Density at a point, zero outside the box
+func (self *DensityGrid) Density(p *Vector3) float64 {
+	size := self.Box.Max.Subtract(&self.Box.Min)
+	u := (p.X - self.Box.Min.X) / size.X
+	v := (p.Y - self.Box.Min.Y) / size.Y
+	w := (p.Z - self.Box.Min.Z) / size.Z
+	if u < 0.0 || u > 1.0 || v < 0.0 || v > 1.0 || w < 0.0 || w > 1.0 {
+		return 0.0
+	}
+	gx := u*float64(self.Nx) - 0.5
+	gy := v*float64(self.Ny) - 0.5
+	gz := w*float64(self.Nz) - 0.5
+	x0, y0, z0 := math.Floor(gx), math.Floor(gy), math.Floor(gz)
+	fx, fy, fz := gx-x0, gy-y0, gz-z0
+	x, y, z := int(x0), int(y0), int(z0)
+	d00 := lerp(fx, self.voxel(x, y, z), self.voxel(x+1, y, z))
+	d10 := lerp(fx, self.voxel(x, y+1, z), self.voxel(x+1, y+1, z))
+	d01 := lerp(fx, self.voxel(x, y, z+1), self.voxel(x+1, y, z+1))
+	d11 := lerp(fx, self.voxel(x, y+1, z+1), self.voxel(x+1, y+1, z+1))
+	return lerp(fz, lerp(fy, d00, d10), lerp(fy, d01, d11))
+}
@@ -0,0 +1,259 @@
+package pathtracer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// FloatImage is a linear RGB image with float precision
+type FloatImage struct {
+	Width  int
+	Height int
+	Pix    []float32
+}
+
+func NewFloatImage(width int, height int) *FloatImage {
+	return &FloatImage{width, height, make([]float32, 3*width*height)}
+}
+
+func (self *FloatImage) At(x int, y int) *Color {
+	i := 3 * (y*self.Width + x)
+	return NewColor(float64(self.Pix[i]), float64(self.Pix[i+1]), float64(self.Pix[i+2]))
+}
+
+func (self *FloatImage) Set(x int, y int, color *Color) {
+	i := 3 * (y*self.Width + x)
+	self.Pix[i] = float32(color.R)
+	self.Pix[i+1] = float32(color.G)
+	self.Pix[i+2] = float32(color.B)
+}
+
+// ToRGBA converts to a displayable 8 bits image through the film response
+func (self *FloatImage) ToRGBA(film *Film) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, self.Width, self.Height))
+	for y := 0; y < self.Height; y++ {
+		for x := 0; x < self.Width; x++ {
+			img.Set(x, y, film.ToneMap(self.At(x, y)))
+		}
+	}
+	return img
+}
+
+// Radiance RGBE reader =====================================================================
+
+func rgbeToColor(rgbe []byte) (float32, float32, float32) {
+	if rgbe[3] == 0 {
+		return 0.0, 0.0, 0.0
+	}
+	f := float32(math.Ldexp(1.0, int(rgbe[3])-(128+8)))
+	return float32(rgbe[0]) * f, float32(rgbe[1]) * f, float32(rgbe[2]) * f
+}
+
+// Reads one scanline, either flat or new style run length encoded
+func readRGBEScanline(reader *bufio.Reader, width int, line []byte) error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+	if width < 8 || width > 0x7fff || header[0] != 2 || header[1] != 2 || header[2]&0x80 != 0 {
+		// Flat scanline
+		copy(line, header)
+		_, err := io.ReadFull(reader, line[4:])
+		return err
+	}
+	if int(header[2])<<8|int(header[3]) != width {
+		return errors.New("Invalid HDR scanline width")
+	}
+	// Run length encoded, each component stored separately
+	for component := 0; component < 4; component++ {
+		x := 0
+		for x < width {
+			count, err := reader.ReadByte()
+			if err != nil {
+				return err
+			}
+			if count > 128 {
+				count -= 128
+				value, err := reader.ReadByte()
+				if err != nil {
+					return err
+				}
+				if x+int(count) > width {
+					return errors.New("Invalid HDR run length")
+				}
+				for i := 0; i < int(count); i++ {
+					line[4*x+component] = value
+					x++
+				}
+			} else {
+				if count == 0 || x+int(count) > width {
+					return errors.New("Invalid HDR run length")
+				}
+				for i := 0; i < int(count); i++ {
+					value, err := reader.ReadByte()
+					if err != nil {
+						return err
+					}
+					line[4*x+component] = value
+					x++
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// LoadHDR reads a Radiance .hdr file. Only the standard -Y height +X width
+// orientation is supported.
+func LoadHDR(filename string) (*FloatImage, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	magic, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(magic, "#?") {
+		return nil, fmt.Errorf("%s: not a Radiance HDR file", filename)
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("%s: truncated header", filename)
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			break
+		}
+		if strings.HasPrefix(line, "FORMAT=") && line != "FORMAT=32-bit_rle_rgbe" {
+			return nil, fmt.Errorf("%s: unsupported format %s", filename, line)
+		}
+	}
+	resolution, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("%s: missing resolution", filename)
+	}
+	var width, height int
+	if _, err := fmt.Sscanf(resolution, "-Y %d +X %d", &height, &width); err != nil {
+		return nil, fmt.Errorf("%s: unsupported resolution line '%s'", filename, strings.TrimSpace(resolution))
+	}
+
+	img := NewFloatImage(width, height)
+	line := make([]byte, 4*width)
+	for y := 0; y < height; y++ {
+		if err := readRGBEScanline(reader, width, line); err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		for x := 0; x < width; x++ {
+			i := 3 * (y*width + x)
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2] = rgbeToColor(line[4*x : 4*x+4])
+		}
+	}
+	return img, nil
+}
+
+// Radiance RGBE writer =====================================================================
+
+func colorToRGBE(r float32, g float32, b float32, rgbe []byte) {
+	v := math.Max(float64(r), math.Max(float64(g), float64(b)))
+	if v < 1e-32 {
+		rgbe[0], rgbe[1], rgbe[2], rgbe[3] = 0, 0, 0, 0
+		return
+	}
+	mantissa, exponent := math.Frexp(v)
+	f := mantissa * 256.0 / v
+	rgbe[0] = byte(math.Max(0.0, float64(r)) * f)
+	rgbe[1] = byte(math.Max(0.0, float64(g)) * f)
+	rgbe[2] = byte(math.Max(0.0, float64(b)) * f)
+	rgbe[3] = byte(exponent + 128)
+}
+
+// Run length encodes one component of a scanline
+func writeRGBERuns(writer *bufio.Writer, data []byte) {
+	const minRun = 4
+	x := 0
+	for x < len(data) {
+		// Find the next run long enough to be worth encoding
+		runStart := x
+		runLength := 0
+		for runStart < len(data) {
+			runLength = 1
+			for runStart+runLength < len(data) && runLength < 127 && data[runStart+runLength] == data[runStart] {
+				runLength++
+			}
+			if runLength >= minRun {
+				break
+			}
+			runStart += runLength
+		}
+		if runLength < minRun {
+			runStart = len(data)
+		}
+		// Literal bytes before the run
+		for x < runStart {
+			count := runStart - x
+			if count > 128 {
+				count = 128
+			}
+			writer.WriteByte(byte(count))
+			writer.Write(data[x : x+count])
+			x += count
+		}
+		if runLength >= minRun {
+			writer.WriteByte(byte(128 + runLength))
+			writer.WriteByte(data[runStart])
+			x += runLength
+		}
+	}
+}
+
+// WriteHDR writes the image as a run length encoded Radiance .hdr file
+func (self *FloatImage) WriteHDR(w io.Writer) error {
+	writer := bufio.NewWriter(w)
+	fmt.Fprintf(writer, "#?RADIANCE\nFORMAT=32-bit_rle_rgbe\n\n-Y %d +X %d\n", self.Height, self.Width)
+	line := make([]byte, 4*self.Width)
+	component := make([]byte, self.Width)
+	for y := 0; y < self.Height; y++ {
+		for x := 0; x < self.Width; x++ {
+			i := 3 * (y*self.Width + x)
+			colorToRGBE(self.Pix[i], self.Pix[i+1], self.Pix[i+2], line[4*x:4*x+4])
+		}
+		if self.Width < 8 || self.Width > 0x7fff {
+			writer.Write(line)
+			continue
+		}
+		writer.Write([]byte{2, 2, byte(self.Width >> 8), byte(self.Width & 0xff)})
+		for c := 0; c < 4; c++ {
+			for x := 0; x < self.Width; x++ {
+				component[x] = line[4*x+c]
+			}
+			writeRGBERuns(writer, component)
+		}
+	}
+	return writer.Flush()
+}
+
+// Portable float map writer =====================================================================
+
+// WritePFM writes the image as a little endian color PFM file
+func (self *FloatImage) WritePFM(w io.Writer) error {
+	writer := bufio.NewWriter(w)
+	fmt.Fprintf(writer, "PF\n%d %d\n-1.0\n", self.Width, self.Height)
+	buffer := make([]byte, 4)
+	// Scanlines are stored from bottom to top
+	for y := self.Height - 1; y >= 0; y-- {
+		for _, value := range self.Pix[3*y*self.Width : 3*(y+1)*self.Width] {
+			binary.LittleEndian.PutUint32(buffer, math.Float32bits(value))
+			writer.Write(buffer)
+		}
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,83 @@
+package pathtracer
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// RGBE keeps 8 bits of mantissa relative to the largest component
+func checkRGBE(t *testing.T, name string, got [3]float32, want [3]float32) {
+	largest := math.Max(float64(want[0]), math.Max(float64(want[1]), float64(want[2])))
+	for c := 0; c < 3; c++ {
+		if math.Abs(float64(got[c]-want[c])) > largest/128.0 {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+			return
+		}
+	}
+}
+
+func TestRGBERoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		color [3]float32
+	}{
+		{"black", [3]float32{0.0, 0.0, 0.0}},
+		{"white", [3]float32{1.0, 1.0, 1.0}},
+		{"color", [3]float32{0.8, 0.4, 0.1}},
+		{"bright", [3]float32{1500.0, 20.0, 0.5}},
+		{"dim", [3]float32{1e-4, 3e-5, 0.0}},
+		{"power of two", [3]float32{0.5, 0.25, 2.0}},
+		{"negative", [3]float32{-1.0, 0.5, 0.25}},
+	}
+	rgbe := make([]byte, 4)
+	for _, test := range tests {
+		colorToRGBE(test.color[0], test.color[1], test.color[2], rgbe)
+		r, g, b := rgbeToColor(rgbe)
+		want := test.color
+		for c := range want {
+			want[c] = float32(math.Max(0.0, float64(want[c])))
+		}
+		checkRGBE(t, test.name, [3]float32{r, g, b}, want)
+	}
+}
+
+func TestHDRFileRoundTrip(t *testing.T) {
+	// Scanlines narrower than 8 pixels are written flat, others run length
+	// encoded
+	for _, width := range []int{5, 300} {
+		img := NewFloatImage(width, 3)
+		for y := 0; y < img.Height; y++ {
+			for x := 0; x < img.Width; x++ {
+				// Runs of equal pixels and varying ones
+				value := float64(x / 10)
+				if y == 1 {
+					value = float64(x)
+				}
+				img.Set(x, y, NewColor(value, 0.5*value+float64(y), 0.1))
+			}
+		}
+		filename := filepath.Join(t.TempDir(), "image.hdr")
+		file, err := os.Create(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = img.WriteHDR(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadHDR(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.Width != img.Width || loaded.Height != img.Height {
+			t.Fatalf("width %d: got %dx%d image", width, loaded.Width, loaded.Height)
+		}
+		for i := 0; i < len(img.Pix); i += 3 {
+			checkRGBE(t, "pixel", [3]float32{loaded.Pix[i], loaded.Pix[i+1], loaded.Pix[i+2]},
+				[3]float32{img.Pix[i], img.Pix[i+1], img.Pix[i+2]})
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package pathtracer
+
+// Instance =====================================================================
+
+// Instance places a shared object with its own transform, without copying the
+// object geometry
+type Instance struct {
+	ObjectBase
+	Object SceneObject
+}
+
+func NewInstance(object SceneObject, transform *Transform) *Instance {
+	return &Instance{ObjectBase{Transform: transform}, object}
+}
+
+func (self *Instance) HitBy(ray *Ray, tmin float64, tmax float64, record *HitRecord) bool {
+	return hitObject(self.Object, ray, tmin, tmax, record)
+}
+
+func (self *Instance) GetMaterial() Material {
+	return self.Object.GetMaterial()
+}
+
+// The shared object is updated once by the world, not by each instance
+func (self *Instance) Update(t0 float64, t1 float64) {
+}
+
+func (self *Instance) BoundingBox() *AABB {
+	return objectBoundingBox(self.Object)
+}
+
+// Group =====================================================================
+
+// Group gathers objects so that they can be transformed and instanced together
+type Group struct {
+	ObjectBase
+	Objects []SceneObject
+	bvh     *BVH
+}
+
+func NewGroup(objects []SceneObject) *Group {
+	return &Group{Objects: objects, bvh: NewBVH(objects)}
+}
+
+func (self *Group) HitBy(ray *Ray, tmin float64, tmax float64, record *HitRecord) bool {
+	return self.bvh.HitBy(ray, tmin, tmax, record)
+}
+
+// Hits are recorded on the grouped objects, a group has no material
+func (self *Group) GetMaterial() Material {
+	return nil
+}
+
+func (self *Group) Update(t0 float64, t1 float64) {
+	for _, obj := range self.Objects {
+		obj.Update(t0, t1)
+	}
+	self.bvh = NewBVH(self.Objects)
+}
+
+func (self *Group) BoundingBox() *AABB {
+	return self.bvh.BoundingBox()
+}
+
+func (self *Group) Primitives() []SceneObject {
+	return self.Objects
+}
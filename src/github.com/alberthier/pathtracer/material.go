@@ -1,40 +1,194 @@
 package pathtracer
 
 import (
+	"fmt"
 	"math"
 	"math/rand"
 )
 
+// Scatter samples an outgoing ray and returns its weight, i.e. the BSDF times
+// the cosine divided by the sampling pdf. Eval and Pdf give these terms for an
+// arbitrary unit direction so that light sampling can be combined with Scatter.
+// Specular materials, which can't be evaluated, return a zero pdf.
 type Material interface {
 	Scatter(rng *rand.Rand, ray *Ray, record *HitRecord) (attenuation *Color, scattered *Ray)
+	Emitted(record *HitRecord) *Color
+	Eval(ray *Ray, record *HitRecord, direction *Vector3) *Color
+	Pdf(ray *Ray, record *HitRecord, direction *Vector3) float64
 }
 
-func NewMaterial(tp string, texture Texture, param float64) Material {
-	switch tp {
+// Composite materials refer to materials defined before them
+func NewMaterial(data *FileMaterial, textures *map[string]Texture, materials *map[string]Material) Material {
+	texture := (*textures)[data.Texture]
+	switch data.Type {
 	case "lambert":
-		return &LambertMaterial{texture}
+		return NewLambertMaterial(texture)
 	case "metal":
-		return &MetalMaterial{texture, math.Min(param, 1.0)}
+		film := newThinFilm(data, textures)
+		if film == nil && data.Film != nil {
+			return nil
+		}
+		return NewMetalMaterial(texture, data.Param, film)
 	case "dielectric":
-		return &DielectricMaterial{param}
+		// Optional tint texture and absorption coefficients per unit distance
+		var absorption *Color
+		if data.Absorption != nil {
+			absorption = NewColor(data.Absorption[0], data.Absorption[1], data.Absorption[2])
+		}
+		// Dispersion from a preset, or fitted to the Abbe number
+		refractiveIndex := data.Param
+		var dispersion Dispersion
+		if len(data.Preset) != 0 {
+			var ok bool
+			if dispersion, ok = NewDispersionPreset(data.Preset); !ok {
+				fmt.Printf("Unknown dielectric preset: '%s'\n", data.Preset)
+				return nil
+			}
+			if refractiveIndex == 0.0 {
+				refractiveIndex = dispersion.RefractiveIndex(referenceWavelength)
+			}
+		} else if data.Abbe > 0.0 {
+			dispersion = NewCauchyDispersion(refractiveIndex, data.Abbe)
+		}
+		film := newThinFilm(data, textures)
+		if film == nil && data.Film != nil {
+			return nil
+		}
+		return NewDielectricMaterial(refractiveIndex, texture, absorption, dispersion, film)
+	case "emissive", "diffuseLight":
+		return NewEmissiveMaterial(texture, data.Param)
+	case "isotropic":
+		return NewPhaseMaterial(texture, 0.0)
+	case "henyeyGreenstein":
+		return NewPhaseMaterial(texture, data.Param)
+	case "conductor":
+		// A preset or explicit complex refractive indices
+		if data.Eta != nil && data.K != nil {
+			return NewConductorMaterial(NewColor(data.Eta[0], data.Eta[1], data.Eta[2]), NewColor(data.K[0], data.K[1], data.K[2]), texture, data.Roughness)
+		}
+		preset := data.Preset
+		if len(preset) == 0 {
+			preset = "aluminium"
+		}
+		eta, k, ok := NewConductorPreset(preset)
+		if !ok {
+			fmt.Printf("Unknown conductor preset: '%s'\n", preset)
+			return nil
+		}
+		return NewConductorMaterial(eta, k, texture, data.Roughness)
+	case "roughDielectric":
+		// A preset or the refractive index given as parameter
+		ior := data.Param
+		if len(data.Preset) != 0 {
+			var ok bool
+			if ior, ok = NewDielectricPreset(data.Preset); !ok {
+				fmt.Printf("Unknown dielectric preset: '%s'\n", data.Preset)
+				return nil
+			}
+		}
+		if ior == 0.0 {
+			ior = 1.5
+		}
+		return NewRoughDielectricMaterial(ior, data.Roughness)
+	case "principled":
+		return newPrincipledMaterial(data, textures)
+	case "mix":
+		// Blends the second material over the first by the parameter or the
+		// texture mask
+		if len(data.Materials) != 2 {
+			fmt.Printf("Mix material '%s' needs two materials\n", data.Name)
+			return nil
+		}
+		first, second := (*materials)[data.Materials[0]], (*materials)[data.Materials[1]]
+		if first == nil || second == nil {
+			fmt.Printf("Unknown materials for mix material '%s'\n", data.Name)
+			return nil
+		}
+		return NewMixMaterial(first, second, NewParameter(data.Param, texture))
+	case "layered":
+		base := (*materials)[data.Base]
+		if base == nil {
+			fmt.Printf("Unknown base material for layered material '%s': '%s'\n", data.Name, data.Base)
+			return nil
+		}
+		ior := 1.5
+		if data.Ior != nil {
+			ior = *data.Ior
+		}
+		return NewLayeredMaterial(base, ior, data.Roughness, texture)
+	case "subsurface":
+		// The albedo and the mean free path in scene units, per channel
+		if texture == nil {
+			texture = NewStaticTexture(NewColor(0.8, 0.8, 0.8))
+			if data.Color != nil {
+				texture = NewStaticTexture(NewColor(data.Color[0], data.Color[1], data.Color[2]))
+			}
+		}
+		meanFreePath := NewColor(0.1, 0.1, 0.1)
+		if data.MeanFreePath != nil {
+			meanFreePath = NewColor(data.MeanFreePath[0], data.MeanFreePath[1], data.MeanFreePath[2])
+		}
+		if meanFreePath.R <= 0.0 || meanFreePath.G <= 0.0 || meanFreePath.B <= 0.0 {
+			fmt.Printf("Invalid mean free path for material '%s'\n", data.Name)
+			return nil
+		}
+		ior := 1.4
+		if data.Ior != nil {
+			ior = *data.Ior
+		}
+		return NewSubsurfaceMaterial(texture, meanFreePath, ior, data.Roughness)
 	}
 	return nil
 }
 
+// Common behaviour of specular materials which do not emit light
+type MaterialBase struct {
+}
+
+func (self *MaterialBase) Emitted(record *HitRecord) *Color {
+	return BlackColor
+}
+
+func (self *MaterialBase) Eval(ray *Ray, record *HitRecord, direction *Vector3) *Color {
+	return BlackColor
+}
+
+func (self *MaterialBase) Pdf(ray *Ray, record *HitRecord, direction *Vector3) float64 {
+	return 0.0
+}
+
 func randomVectorInUnitSphere(rng *rand.Rand) *Vector3 {
 	for {
 		r := NewVector(rng.Float64(), rng.Float64(), rng.Float64())
 		p := r.Scale(2.0).Subtract(UnitVector)
-		if p.SquaredLength() >= 1.0 {
+		if p.SquaredLength() < 1.0 {
 			return p
 		}
 	}
 }
 
+func randomUnitVector(rng *rand.Rand) *Vector3 {
+	for {
+		p := randomVectorInUnitSphere(rng)
+		if p.SquaredLength() > 1e-12 {
+			return p.Unit()
+		}
+	}
+}
+
 func reflect(v *Vector3, n *Vector3) *Vector3 {
 	return v.Subtract(n.Scale(2.0 * v.Dot(n)))
 }
 
+// Normal on the side the ray comes from. Open surfaces such as triangles can
+// be hit from behind.
+func facingNormal(ray *Ray, record *HitRecord) *Vector3 {
+	if ray.Direction.Dot(record.normal) > 0.0 {
+		return record.normal.Scale(-1.0)
+	}
+	return record.normal
+}
+
 func refract(v *Vector3, n *Vector3, niOverNt float64) *Vector3 {
 	uv := v.Unit()
 	dot := uv.Dot(n)
@@ -49,36 +203,89 @@ func refract(v *Vector3, n *Vector3, niOverNt float64) *Vector3 {
 // Lambert =====================================================================
 
 type LambertMaterial struct {
+	MaterialBase
 	albedo Texture
 }
 
+func NewLambertMaterial(albedo Texture) *LambertMaterial {
+	return &LambertMaterial{albedo: albedo}
+}
+
+// Offsetting the normal by a random unit vector gives a cosine distribution
 func (self *LambertMaterial) Scatter(rng *rand.Rand, ray *Ray, record *HitRecord) (attenuation *Color, scattered *Ray) {
-	rnd := randomVectorInUnitSphere(rng)
-	target := record.point.Add(record.normal).Add(rnd)
-	scattered = NewRay(record.point, target.Subtract(record.point))
-	return self.albedo.Color(record.point), scattered
+	direction := facingNormal(ray, record).Add(randomUnitVector(rng))
+	if direction.SquaredLength() < 1e-12 {
+		direction = facingNormal(ray, record)
+	}
+	scattered = NewRay(record.point, direction, ray.Time)
+	return self.albedo.Color(record.u, record.v, record.point), scattered
+}
+
+func (self *LambertMaterial) Eval(ray *Ray, record *HitRecord, direction *Vector3) *Color {
+	cosine := facingNormal(ray, record).Dot(direction)
+	if cosine <= 0.0 {
+		return BlackColor
+	}
+	albedo := self.albedo.Color(record.u, record.v, record.point)
+	f := cosine / math.Pi
+	return NewColor(albedo.R*f, albedo.G*f, albedo.B*f)
+}
+
+func (self *LambertMaterial) Pdf(ray *Ray, record *HitRecord, direction *Vector3) float64 {
+	return math.Max(0.0, facingNormal(ray, record).Dot(direction)) / math.Pi
 }
 
 // Metal =====================================================================
 
+// MetalMaterial reflects with its albedo. Under the optional thin film, the
+// metal is approximated by a dielectric reflecting the albedo at normal
+// incidence.
 type MetalMaterial struct {
+	MaterialBase
 	albedo    Texture
 	fuzziness float64
+	film      *ThinFilm
+}
+
+func NewMetalMaterial(albedo Texture, fuzziness float64, film *ThinFilm) *MetalMaterial {
+	return &MetalMaterial{albedo: albedo, fuzziness: math.Min(fuzziness, 1.0), film: film}
 }
 
 func (self *MetalMaterial) Scatter(rng *rand.Rand, ray *Ray, record *HitRecord) (attenuation *Color, scattered *Ray) {
-	reflected := reflect(ray.Direction, record.normal)
-	if reflected.Dot(record.normal) <= 0.0 {
+	normal := facingNormal(ray, record)
+	reflected := reflect(ray.Direction, normal)
+	if reflected.Dot(normal) <= 0.0 {
 		return nil, nil
 	}
-	scattered = NewRay(record.point, reflected.Add(randomVectorInUnitSphere(rng).Scale(self.fuzziness)))
-	return self.albedo.Color(record.point), scattered
+	scattered = NewRay(record.point, reflected.Add(randomVectorInUnitSphere(rng).Scale(self.fuzziness)), ray.Time)
+	albedo := self.albedo.Color(record.u, record.v, record.point)
+	if self.film != nil {
+		cosine := -ray.Direction.Dot(normal) / ray.Direction.Length()
+		return self.film.Reflectance(record, cosine, 1.0, func(wavelength float64) complex128 {
+			return complex(reflectanceToRefractiveIndex(rgbToSpectrum(albedo, wavelength)), 0.0)
+		}), scattered
+	}
+	return albedo, scattered
 }
 
 // Dielectric =====================================================================
 
+// DielectricMaterial is a smooth glass. Refraction into the object is tinted
+// by the optional texture, and light is absorbed inside following the
+// Beer-Lambert law, over the distance rays travel in its interior.
+// The dispersion is only used in spectral mode. The optional thin film coats
+// the outer side of the surface.
 type DielectricMaterial struct {
+	MaterialBase
 	refractiveIndex float64
+	tint            Texture
+	absorption      *Color
+	dispersion      Dispersion
+	film            *ThinFilm
+}
+
+func NewDielectricMaterial(refractiveIndex float64, tint Texture, absorption *Color, dispersion Dispersion, film *ThinFilm) *DielectricMaterial {
+	return &DielectricMaterial{refractiveIndex: refractiveIndex, tint: tint, absorption: absorption, dispersion: dispersion, film: film}
 }
 
 func schlick(cosine float64, refractiveIndex float64) float64 {
@@ -92,31 +299,181 @@ func (self *DielectricMaterial) Scatter(rng *rand.Rand, ray *Ray, record *HitRec
 	var niOverNt float64
 	var cosine float64
 
+	refractiveIndex := self.refractiveIndex
+	dispersive := self.dispersion != nil && ray.Wavelength != 0.0
+	if dispersive {
+		refractiveIndex = self.dispersion.RefractiveIndex(ray.Wavelength)
+	}
+
 	dot := ray.Direction.Dot(record.normal)
 	if dot > 0 {
 		outNormal = record.normal.Scale(-1.0)
-		niOverNt = self.refractiveIndex
+		niOverNt = refractiveIndex
 		cosine = dot / ray.Direction.Length()
 	} else {
 		outNormal = record.normal
-		niOverNt = 1.0 / self.refractiveIndex
+		niOverNt = 1.0 / refractiveIndex
 		cosine = -dot / ray.Direction.Length()
 	}
 
 	refracted := refract(ray.Direction, outNormal, niOverNt)
-	if refracted != nil {
-		if schlick(cosine, self.refractiveIndex) > rng.Float64() {
+	filmWeight := NewColor(1.0, 1.0, 1.0)
+	if refracted != nil && self.film != nil {
+		// The colored film reflectance is sampled with its average, the film
+		// lying on the outer side of the surface
+		var reflectance *Color
+		if dot > 0 {
+			reflectance = self.film.Reflectance(record, cosine, refractiveIndex, func(wavelength float64) complex128 {
+				return complex(1.0, 0.0)
+			})
+		} else {
+			reflectance = self.film.Reflectance(record, cosine, 1.0, func(wavelength float64) complex128 {
+				if self.dispersion != nil {
+					return complex(self.dispersion.RefractiveIndex(wavelength), 0.0)
+				}
+				return complex(refractiveIndex, 0.0)
+			})
+		}
+		probability := (reflectance.R + reflectance.G + reflectance.B) / 3.0
+		if rng.Float64() < probability {
+			refracted = nil
+			filmWeight = NewColor(reflectance.R/probability, reflectance.G/probability, reflectance.B/probability)
+		} else {
+			filmWeight = NewColor((1.0-reflectance.R)/(1.0-probability), (1.0-reflectance.G)/(1.0-probability), (1.0-reflectance.B)/(1.0-probability))
+		}
+	} else if refracted != nil {
+		if schlick(cosine, refractiveIndex) > rng.Float64() {
 			refracted = nil
 		}
 	}
 	if refracted != nil {
-		scattered = NewRay(record.point, refracted)
+		scattered = NewRay(record.point, refracted, ray.Time)
 	} else {
 		reflected := reflect(ray.Direction, outNormal)
-		scattered = NewRay(record.point, reflected)
+		scattered = NewRay(record.point, reflected, ray.Time)
 	}
+	scattered.Monochromatic = dispersive
 
-	attenuation = WhiteColor
+	attenuation = NewColor(1.0, 1.0, 1.0)
+	if dot <= 0 && refracted != nil && self.tint != nil {
+		attenuation = self.tint.Color(record.u, record.v, record.point)
+	}
+	attenuation = NewColor(attenuation.R*filmWeight.R, attenuation.G*filmWeight.G, attenuation.B*filmWeight.B)
 
 	return attenuation, scattered
 }
+
+// Absorbing dielectrics the scattered ray travels in. Refraction into one of
+// them enters it, refraction out of it leaves its innermost occurrence, so
+// that nested and overlapping objects are handled.
+func scatteredInterior(material Material, ray *Ray, scattered *Ray, record *HitRecord) []*DielectricMaterial {
+	dielectric, ok := material.(*DielectricMaterial)
+	if !ok || dielectric.absorption == nil {
+		return ray.Interior
+	}
+	in := ray.Direction.Dot(record.normal)
+	out := scattered.Direction.Dot(record.normal)
+	if in < 0.0 && out < 0.0 {
+		interior := make([]*DielectricMaterial, len(ray.Interior), len(ray.Interior)+1)
+		copy(interior, ray.Interior)
+		return append(interior, dielectric)
+	}
+	if in > 0.0 && out > 0.0 {
+		for i := len(ray.Interior) - 1; i >= 0; i-- {
+			if ray.Interior[i] == dielectric {
+				interior := make([]*DielectricMaterial, 0, len(ray.Interior)-1)
+				interior = append(interior, ray.Interior[:i]...)
+				return append(interior, ray.Interior[i+1:]...)
+			}
+		}
+	}
+	return ray.Interior
+}
+
+// Transmittance of the innermost dielectric the ray travels in, over the
+// distance to the point at t
+func (self *Ray) absorption(t float64) *Color {
+	if len(self.Interior) == 0 {
+		return NewColor(1.0, 1.0, 1.0)
+	}
+	absorption := self.Interior[len(self.Interior)-1].absorption
+	distance := t * self.Direction.Length()
+	return NewColor(math.Exp(-absorption.R*distance),
+		math.Exp(-absorption.G*distance),
+		math.Exp(-absorption.B*distance))
+}
+
+// Emissive =====================================================================
+
+type EmissiveMaterial struct {
+	MaterialBase
+	emit     Texture
+	strength float64
+}
+
+// A zero strength defaults to 1
+func NewEmissiveMaterial(emit Texture, strength float64) *EmissiveMaterial {
+	if strength == 0.0 {
+		strength = 1.0
+	}
+	return &EmissiveMaterial{emit: emit, strength: strength}
+}
+
+func (self *EmissiveMaterial) Scatter(rng *rand.Rand, ray *Ray, record *HitRecord) (attenuation *Color, scattered *Ray) {
+	return nil, nil
+}
+
+func (self *EmissiveMaterial) Emitted(record *HitRecord) *Color {
+	color := self.emit.Color(record.u, record.v, record.point)
+	return NewColor(color.R*self.strength, color.G*self.strength, color.B*self.strength)
+}
+
+// Phase =====================================================================
+
+// PhaseMaterial scatters light inside participating media following the
+// Henyey-Greenstein phase function. Positive anisotropy favours forward
+// scattering, zero is isotropic.
+type PhaseMaterial struct {
+	MaterialBase
+	albedo     Texture
+	anisotropy float64
+}
+
+func NewPhaseMaterial(albedo Texture, anisotropy float64) *PhaseMaterial {
+	return &PhaseMaterial{albedo: albedo, anisotropy: math.Max(-0.99, math.Min(anisotropy, 0.99))}
+}
+
+// Phase function value for the cosine between the propagation directions
+func (self *PhaseMaterial) phase(cosine float64) float64 {
+	g := self.anisotropy
+	denom := 1.0 + g*g - 2.0*g*cosine
+	return (1.0 - g*g) / (4.0 * math.Pi * denom * math.Sqrt(denom))
+}
+
+// The phase function is sampled exactly, so the weight is the albedo
+func (self *PhaseMaterial) Scatter(rng *rand.Rand, ray *Ray, record *HitRecord) (attenuation *Color, scattered *Ray) {
+	g := self.anisotropy
+	var cosine float64
+	if math.Abs(g) < 1e-3 {
+		cosine = 1.0 - 2.0*rng.Float64()
+	} else {
+		s := (1.0 - g*g) / (1.0 - g + 2.0*g*rng.Float64())
+		cosine = (1.0 + g*g - s*s) / (2.0 * g)
+	}
+	sine := math.Sqrt(math.Max(0.0, 1.0-cosine*cosine))
+	phi := 2.0 * math.Pi * rng.Float64()
+	w := ray.Direction.Unit()
+	u, v := w.OrthonormalBasis()
+	direction := u.Scale(sine * math.Cos(phi)).Add(v.Scale(sine * math.Sin(phi))).Add(w.Scale(cosine))
+	return self.albedo.Color(record.u, record.v, record.point), NewRay(record.point, direction, ray.Time)
+}
+
+func (self *PhaseMaterial) Eval(ray *Ray, record *HitRecord, direction *Vector3) *Color {
+	albedo := self.albedo.Color(record.u, record.v, record.point)
+	p := self.phase(ray.Direction.Unit().Dot(direction))
+	return NewColor(albedo.R*p, albedo.G*p, albedo.B*p)
+}
+
+func (self *PhaseMaterial) Pdf(ray *Ray, record *HitRecord, direction *Vector3) float64 {
+	return self.phase(ray.Direction.Unit().Dot(direction))
+}
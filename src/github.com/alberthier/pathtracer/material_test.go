@@ -0,0 +1,70 @@
+package pathtracer
+
+import (
+	"math"
+	"testing"
+)
+
+func TestScatteredInterior(t *testing.T) {
+	glass := NewDielectricMaterial(1.5, nil, NewColor(0.1, 0.2, 0.3), nil, nil)
+	water := NewDielectricMaterial(1.33, nil, NewColor(1.0, 0.5, 0.0), nil, nil)
+	clear := NewDielectricMaterial(1.5, nil, nil, nil, nil)
+	// The surface normal points up, out of the objects
+	record := &HitRecord{normal: NewVector(0.0, 1.0, 0.0)}
+	down := NewVector(0.0, -1.0, 0.0)
+	up := NewVector(0.0, 1.0, 0.0)
+	tests := []struct {
+		name     string
+		material Material
+		interior []*DielectricMaterial
+		in, out  *Vector3
+		want     []*DielectricMaterial
+	}{
+		{"entering", glass, nil, down, down, []*DielectricMaterial{glass}},
+		{"nested", water, []*DielectricMaterial{glass}, down, down, []*DielectricMaterial{glass, water}},
+		{"leaving nested", water, []*DielectricMaterial{glass, water}, up, up, []*DielectricMaterial{glass}},
+		{"leaving overlapped", glass, []*DielectricMaterial{glass, water}, up, up, []*DielectricMaterial{water}},
+		{"reflected outside", glass, nil, down, up, nil},
+		{"reflected inside", glass, []*DielectricMaterial{glass}, up, down, []*DielectricMaterial{glass}},
+		{"not absorbing", clear, []*DielectricMaterial{glass}, down, down, []*DielectricMaterial{glass}},
+		{"other material", NewLambertMaterial(nil), []*DielectricMaterial{glass}, down, up, []*DielectricMaterial{glass}},
+	}
+	for _, test := range tests {
+		ray := &Ray{Direction: test.in, Interior: test.interior}
+		got := scatteredInterior(test.material, ray, NewRay(nil, test.out, 0.0), record)
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+// Light is absorbed by the innermost dielectric over the distance travelled
+func TestRayAbsorption(t *testing.T) {
+	glass := NewDielectricMaterial(1.5, nil, NewColor(0.1, 0.2, 0.3), nil, nil)
+	water := NewDielectricMaterial(1.33, nil, NewColor(1.0, 0.5, 0.0), nil, nil)
+	tests := []struct {
+		name     string
+		interior []*DielectricMaterial
+		t        float64
+		want     *Color
+	}{
+		{"outside", nil, 10.0, NewColor(1.0, 1.0, 1.0)},
+		{"glass", []*DielectricMaterial{glass}, 1.0, NewColor(math.Exp(-0.2), math.Exp(-0.4), math.Exp(-0.6))},
+		{"water in glass", []*DielectricMaterial{glass, water}, 1.0, NewColor(math.Exp(-2.0), math.Exp(-1.0), 1.0)},
+	}
+	for _, test := range tests {
+		// The direction is not normalized, distances are
+		ray := &Ray{Direction: NewVector(0.0, 2.0, 0.0), Interior: test.interior}
+		got := ray.absorption(test.t)
+		if math.Abs(got.R-test.want.R) > 1e-12 || math.Abs(got.G-test.want.G) > 1e-12 || math.Abs(got.B-test.want.B) > 1e-12 {
+			t.Errorf("%s: got %v, want %v", test.name, *got, *test.want)
+		}
+	}
+}
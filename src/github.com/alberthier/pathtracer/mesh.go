@@ -0,0 +1,66 @@
+package pathtracer
+
+type MeshFace struct {
+	Vertices [3]int
+	Normals  [3]int
+	UVs      [3]int
+	Material Material
+}
+
+// Mesh holds vertex buffers shared by all its triangles. Face indices refer to
+// these buffers, a negative normal or UV index meaning the attribute is absent.
+type Mesh struct {
+	ObjectBase
+	Vertices  []*Vector3
+	Normals   []*Vector3
+	UVs       []*Vector3
+	Faces     []MeshFace
+	Material  Material
+	Triangles []SceneObject
+	bvh       *BVH
+}
+
+func NewMesh(vertices []*Vector3, normals []*Vector3, uvs []*Vector3, faces []MeshFace, material Material) *Mesh {
+	self := &Mesh{Vertices: vertices, Normals: normals, UVs: uvs, Faces: faces, Material: material}
+	for _, face := range faces {
+		// Degenerate faces can't be hit nor sampled, they only count in the
+		// mesh topology
+		v0, v1, v2 := vertices[face.Vertices[0]], vertices[face.Vertices[1]], vertices[face.Vertices[2]]
+		if isDegenerate(v0, v1, v2) {
+			continue
+		}
+		faceMaterial := face.Material
+		if faceMaterial == nil {
+			faceMaterial = material
+		}
+		triangle := NewTriangle(v0, v1, v2, faceMaterial)
+		if face.Normals[0] >= 0 && face.Normals[1] >= 0 && face.Normals[2] >= 0 {
+			triangle.SetNormals(normals[face.Normals[0]], normals[face.Normals[1]], normals[face.Normals[2]])
+		}
+		if face.UVs[0] >= 0 && face.UVs[1] >= 0 && face.UVs[2] >= 0 {
+			triangle.SetUVs(uvs[face.UVs[0]], uvs[face.UVs[1]], uvs[face.UVs[2]])
+		}
+		self.Triangles = append(self.Triangles, triangle)
+	}
+	self.bvh = NewBVH(self.Triangles)
+	return self
+}
+
+func (self *Mesh) HitBy(ray *Ray, tmin float64, tmax float64, record *HitRecord) bool {
+	return self.bvh.HitBy(ray, tmin, tmax, record)
+}
+
+func (self *Mesh) GetMaterial() Material {
+	return self.Material
+}
+
+func (self *Mesh) Update(t0 float64, t1 float64) {
+}
+
+func (self *Mesh) BoundingBox() *AABB {
+	return self.bvh.BoundingBox()
+}
+
+func (self *Mesh) Primitives() []SceneObject {
+	return self.Triangles
+}
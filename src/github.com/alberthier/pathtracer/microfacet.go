@@ -0,0 +1,316 @@
+package pathtracer
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Complex refractive indices of conductors at 650, 550 and 450 nm
+var conductorPresets = map[string][2][3]float64{
+	"gold":      {{0.143, 0.374, 1.442}, {3.983, 2.385, 1.603}},
+	"copper":    {{0.200, 0.924, 1.102}, {3.912, 2.452, 2.142}},
+	"aluminium": {{1.657, 0.880, 0.521}, {9.224, 6.270, 4.837}},
+	"silver":    {{0.155, 0.117, 0.138}, {4.828, 3.122, 2.147}},
+}
+
+var dielectricPresets = map[string]float64{
+	"water":   1.333,
+	"glass":   1.5,
+	"diamond": 2.417,
+}
+
+// NewConductorPreset returns the refractive index and extinction coefficient
+// of a named conductor
+func NewConductorPreset(name string) (eta *Color, k *Color, ok bool) {
+	preset, ok := conductorPresets[name]
+	if !ok {
+		return nil, nil, false
+	}
+	return NewColor(preset[0][0], preset[0][1], preset[0][2]), NewColor(preset[1][0], preset[1][1], preset[1][2]), true
+}
+
+func NewDielectricPreset(name string) (float64, bool) {
+	ior, ok := dielectricPresets[name]
+	return ior, ok
+}
+
+// GGX =====================================================================
+
+// ggx is the Trowbridge-Reitz distribution of microfacet normals, in a local
+// frame whose Z axis is the surface normal
+type ggx struct {
+	alpha float64
+}
+
+// Roughness is perceptual, alpha is its square
+func newGGX(roughness float64) ggx {
+	roughness = math.Max(0.0, math.Min(roughness, 1.0))
+	return ggx{math.Max(roughness*roughness, 1e-4)}
+}
+
+func (self ggx) D(h *Vector3) float64 {
+	if h.Z <= 0.0 {
+		return 0.0
+	}
+	a2 := self.alpha * self.alpha
+	d := h.Z*h.Z*(a2-1.0) + 1.0
+	return a2 / (math.Pi * d * d)
+}
+
+func (self ggx) lambda(v *Vector3) float64 {
+	cos2 := v.Z * v.Z
+	if cos2 <= 0.0 {
+		return math.Inf(1)
+	}
+	tan2 := math.Max(0.0, 1.0-cos2) / cos2
+	return (math.Sqrt(1.0+self.alpha*self.alpha*tan2) - 1.0) / 2.0
+}
+
+func (self ggx) G1(v *Vector3) float64 {
+	return 1.0 / (1.0 + self.lambda(v))
+}
+
+func (self ggx) G2(wo *Vector3, wi *Vector3) float64 {
+	return 1.0 / (1.0 + self.lambda(wo) + self.lambda(wi))
+}
+
+// Sampling of the normals visible from wo (Heitz 2018). The pdf of h is
+// G1(wo) max(0, wo.h) D(h) / wo.z.
+func (self ggx) sampleVisibleNormal(rng *rand.Rand, wo *Vector3) *Vector3 {
+	vh := NewVector(self.alpha*wo.X, self.alpha*wo.Y, wo.Z).Unit()
+	t1 := NewVector(1.0, 0.0, 0.0)
+	if length2 := vh.X*vh.X + vh.Y*vh.Y; length2 > 0.0 {
+		t1 = NewVector(-vh.Y, vh.X, 0.0).Scale(1.0 / math.Sqrt(length2))
+	}
+	t2 := vh.Cross(t1)
+	r := math.Sqrt(rng.Float64())
+	phi := 2.0 * math.Pi * rng.Float64()
+	p1 := r * math.Cos(phi)
+	p2 := r * math.Sin(phi)
+	s := 0.5 * (1.0 + vh.Z)
+	p2 = (1.0-s)*math.Sqrt(math.Max(0.0, 1.0-p1*p1)) + s*p2
+	nh := t1.Scale(p1).Add(t2.Scale(p2)).Add(vh.Scale(math.Sqrt(math.Max(0.0, 1.0-p1*p1-p2*p2))))
+	return NewVector(self.alpha*nh.X, self.alpha*nh.Y, math.Max(1e-6, nh.Z)).Unit()
+}
+
+// localFrame converts directions to and from a frame around a normal
+type localFrame struct {
+	u *Vector3
+	v *Vector3
+	n *Vector3
+}
+
+func newLocalFrame(n *Vector3) localFrame {
+	u, v := n.OrthonormalBasis()
+	return localFrame{u, v, n}
+}
+
+func (self localFrame) toLocal(d *Vector3) *Vector3 {
+	return NewVector(d.Dot(self.u), d.Dot(self.v), d.Dot(self.n))
+}
+
+func (self localFrame) toWorld(d *Vector3) *Vector3 {
+	return self.u.Scale(d.X).Add(self.v.Scale(d.Y)).Add(self.n.Scale(d.Z))
+}
+
+// Fresnel reflectance of a conductor for one channel
+func fresnelConductor(cosine float64, eta float64, k float64) float64 {
+	cos2 := cosine * cosine
+	sin2 := 1.0 - cos2
+	eta2 := eta * eta
+	k2 := k * k
+	t0 := eta2 - k2 - sin2
+	a2b2 := math.Sqrt(math.Max(0.0, t0*t0+4.0*eta2*k2))
+	t1 := a2b2 + cos2
+	a := math.Sqrt(math.Max(0.0, 0.5*(a2b2+t0)))
+	t2 := 2.0 * cosine * a
+	rs := (t1 - t2) / (t1 + t2)
+	t3 := cos2*a2b2 + sin2*sin2
+	t4 := t2 * sin2
+	rp := rs * (t3 - t4) / (t3 + t4)
+	return 0.5 * (rp + rs)
+}
+
+// Exact Fresnel reflectance of a dielectric interface, eta being the ratio of
+// the refractive indices of the transmitted and incident sides
+func fresnelDielectric(cosine float64, eta float64) float64 {
+	sin2 := (1.0 - cosine*cosine) / (eta * eta)
+	if sin2 >= 1.0 {
+		return 1.0
+	}
+	cosT := math.Sqrt(1.0 - sin2)
+	rs := (cosine - eta*cosT) / (cosine + eta*cosT)
+	rp := (eta*cosine - cosT) / (eta*cosine + cosT)
+	return 0.5 * (rs*rs + rp*rp)
+}
+
+// Conductor =====================================================================
+
+// ConductorMaterial is a rough metal with complex Fresnel reflectance. The
+// texture tints the reflectance.
+type ConductorMaterial struct {
+	MaterialBase
+	eta          *Color
+	k            *Color
+	tint         Texture
+	distribution ggx
+}
+
+func NewConductorMaterial(eta *Color, k *Color, tint Texture, roughness float64) *ConductorMaterial {
+	return &ConductorMaterial{eta: eta, k: k, tint: tint, distribution: newGGX(roughness)}
+}
+
+func (self *ConductorMaterial) fresnel(cosine float64, record *HitRecord) *Color {
+	f := NewColor(fresnelConductor(cosine, self.eta.R, self.k.R),
+		fresnelConductor(cosine, self.eta.G, self.k.G),
+		fresnelConductor(cosine, self.eta.B, self.k.B))
+	if self.tint != nil {
+		tint := self.tint.Color(record.u, record.v, record.point)
+		f = NewColor(f.R*tint.R, f.G*tint.G, f.B*tint.B)
+	}
+	return f
+}
+
+func (self *ConductorMaterial) Scatter(rng *rand.Rand, ray *Ray, record *HitRecord) (attenuation *Color, scattered *Ray) {
+	frame := newLocalFrame(facingNormal(ray, record))
+	wo := frame.toLocal(ray.Direction.Unit().Scale(-1.0))
+	if wo.Z <= 0.0 {
+		return nil, nil
+	}
+	h := self.distribution.sampleVisibleNormal(rng, wo)
+	wi := reflect(wo.Scale(-1.0), h)
+	if wi.Z <= 0.0 {
+		return nil, nil
+	}
+	f := self.fresnel(wo.Dot(h), record)
+	weight := self.distribution.G2(wo, wi) / self.distribution.G1(wo)
+	f.MultiplyAll(weight)
+	return f, NewRay(record.point, frame.toWorld(wi), ray.Time)
+}
+
+func (self *ConductorMaterial) Eval(ray *Ray, record *HitRecord, direction *Vector3) *Color {
+	frame := newLocalFrame(facingNormal(ray, record))
+	wo := frame.toLocal(ray.Direction.Unit().Scale(-1.0))
+	wi := frame.toLocal(direction)
+	if wo.Z <= 0.0 || wi.Z <= 0.0 {
+		return BlackColor
+	}
+	h := wo.Add(wi).Unit()
+	f := self.fresnel(wo.Dot(h), record)
+	f.MultiplyAll(self.distribution.D(h) * self.distribution.G2(wo, wi) / (4.0 * wo.Z))
+	return f
+}
+
+func (self *ConductorMaterial) Pdf(ray *Ray, record *HitRecord, direction *Vector3) float64 {
+	frame := newLocalFrame(facingNormal(ray, record))
+	wo := frame.toLocal(ray.Direction.Unit().Scale(-1.0))
+	wi := frame.toLocal(direction)
+	if wo.Z <= 0.0 || wi.Z <= 0.0 {
+		return 0.0
+	}
+	h := wo.Add(wi).Unit()
+	return self.distribution.G1(wo) * self.distribution.D(h) / (4.0 * wo.Z)
+}
+
+// Rough dielectric =====================================================================
+
+// RoughDielectricMaterial reflects and refracts through rough microfacets.
+// Like the smooth dielectric, refracted radiance is not scaled by the
+// refractive index ratio.
+type RoughDielectricMaterial struct {
+	MaterialBase
+	refractiveIndex float64
+	distribution    ggx
+}
+
+func NewRoughDielectricMaterial(refractiveIndex float64, roughness float64) *RoughDielectricMaterial {
+	return &RoughDielectricMaterial{refractiveIndex: refractiveIndex, distribution: newGGX(roughness)}
+}
+
+// Frame on the side of the incoming ray, and the refractive index ratio of
+// the other side over this one
+func (self *RoughDielectricMaterial) frame(ray *Ray, record *HitRecord) (localFrame, float64) {
+	if ray.Direction.Dot(record.normal) > 0.0 {
+		return newLocalFrame(record.normal.Scale(-1.0)), 1.0 / self.refractiveIndex
+	}
+	return newLocalFrame(record.normal), self.refractiveIndex
+}
+
+// Samples reflection or refraction through a rough dielectric interface in
+// the local frame. Returns nil when the sampled direction is invalid.
+func sampleRoughDielectric(rng *rand.Rand, d ggx, wo *Vector3, eta float64) *Vector3 {
+	h := d.sampleVisibleNormal(rng, wo)
+	cosine := wo.Dot(h)
+	// Choosing between reflection and refraction with the Fresnel term
+	// cancels it from the weight
+	if rng.Float64() < fresnelDielectric(cosine, eta) {
+		wi := reflect(wo.Scale(-1.0), h)
+		if wi.Z <= 0.0 {
+			return nil
+		}
+		return wi
+	}
+	cosT := math.Sqrt(math.Max(0.0, 1.0-(1.0-cosine*cosine)/(eta*eta)))
+	wi := wo.Scale(-1.0 / eta).Add(h.Scale(cosine/eta - cosT))
+	if wi.Z >= 0.0 {
+		return nil
+	}
+	return wi
+}
+
+// Returns the BSDF times the cosine and the pdf of sampleRoughDielectric in
+// the local frame
+func evalRoughDielectric(d ggx, wo *Vector3, wi *Vector3, eta float64) (float64, float64) {
+	if wo.Z <= 0.0 || wi.Z == 0.0 {
+		return 0.0, 0.0
+	}
+	if wi.Z > 0.0 {
+		h := wo.Add(wi).Unit()
+		fresnel := fresnelDielectric(wo.Dot(h), eta)
+		return fresnel * d.D(h) * d.G2(wo, wi) / (4.0 * wo.Z), fresnel * d.G1(wo) * d.D(h) / (4.0 * wo.Z)
+	}
+	h := wo.Add(wi.Scale(eta)).Unit()
+	if h.Z < 0.0 {
+		h = h.Scale(-1.0)
+	}
+	cosO := wo.Dot(h)
+	cosI := wi.Dot(h)
+	if cosO <= 0.0 || cosI >= 0.0 {
+		return 0.0, 0.0
+	}
+	denom := cosO + eta*cosI
+	jacobian := eta * eta * -cosI / (denom * denom)
+	transmission := 1.0 - fresnelDielectric(cosO, eta)
+	pdf := transmission * d.G1(wo) * d.D(h) * cosO / wo.Z * jacobian
+	return pdf * d.G2(wo, wi) / d.G1(wo), pdf
+}
+
+func (self *RoughDielectricMaterial) Scatter(rng *rand.Rand, ray *Ray, record *HitRecord) (attenuation *Color, scattered *Ray) {
+	frame, eta := self.frame(ray, record)
+	wo := frame.toLocal(ray.Direction.Unit().Scale(-1.0))
+	if wo.Z <= 0.0 {
+		return nil, nil
+	}
+	wi := sampleRoughDielectric(rng, self.distribution, wo, eta)
+	if wi == nil {
+		return nil, nil
+	}
+	weight := self.distribution.G2(wo, wi) / self.distribution.G1(wo)
+	return NewColor(weight, weight, weight), NewRay(record.point, frame.toWorld(wi), ray.Time)
+}
+
+// evalPdf returns the BSDF times the cosine and the pdf of Scatter
+func (self *RoughDielectricMaterial) evalPdf(ray *Ray, record *HitRecord, direction *Vector3) (float64, float64) {
+	frame, eta := self.frame(ray, record)
+	return evalRoughDielectric(self.distribution, frame.toLocal(ray.Direction.Unit().Scale(-1.0)), frame.toLocal(direction), eta)
+}
+
+func (self *RoughDielectricMaterial) Eval(ray *Ray, record *HitRecord, direction *Vector3) *Color {
+	f, _ := self.evalPdf(ray, record, direction)
+	return NewColor(f, f, f)
+}
+
+func (self *RoughDielectricMaterial) Pdf(ray *Ray, record *HitRecord, direction *Vector3) float64 {
+	_, pdf := self.evalPdf(ray, record, direction)
+	return pdf
+}
@@ -0,0 +1,168 @@
+package pathtracer
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Mix =====================================================================
+
+// MixMaterial blends two materials, the factor giving the weight of the
+// second one. Scatter picks one of them with its weight.
+type MixMaterial struct {
+	first  Material
+	second Material
+	factor Parameter
+}
+
+func NewMixMaterial(first Material, second Material, factor Parameter) *MixMaterial {
+	return &MixMaterial{first, second, factor}
+}
+
+func (self *MixMaterial) weight(record *HitRecord) float64 {
+	return clamp(self.factor.Get(record), 0.0, 1.0)
+}
+
+// Directions sampled from a specular component can't be evaluated, their
+// weight is the one of the component. The others are weighted by the whole
+// blend.
+func (self *MixMaterial) Scatter(rng *rand.Rand, ray *Ray, record *HitRecord) (attenuation *Color, scattered *Ray) {
+	material := self.first
+	if rng.Float64() < self.weight(record) {
+		material = self.second
+	}
+	attenuation, scattered = material.Scatter(rng, ray, record)
+	if attenuation == nil || scattered == nil {
+		return nil, nil
+	}
+	direction := scattered.Direction.Unit()
+	if scattered.Specular || material.Pdf(ray, record, direction) == 0.0 {
+		scattered.Specular = true
+		return attenuation, scattered
+	}
+	f := self.Eval(ray, record, direction)
+	f.DivideAll(self.Pdf(ray, record, direction))
+	return f, scattered
+}
+
+func (self *MixMaterial) Emitted(record *HitRecord) *Color {
+	return lerpColor(self.weight(record), self.first.Emitted(record), self.second.Emitted(record))
+}
+
+func (self *MixMaterial) Eval(ray *Ray, record *HitRecord, direction *Vector3) *Color {
+	return lerpColor(self.weight(record), self.first.Eval(ray, record, direction), self.second.Eval(ray, record, direction))
+}
+
+func (self *MixMaterial) Pdf(ray *Ray, record *HitRecord, direction *Vector3) float64 {
+	return lerp(self.weight(record), self.first.Pdf(ray, record, direction), self.second.Pdf(ray, record, direction))
+}
+
+// Layered =====================================================================
+
+// LayeredMaterial is a clear dielectric coat over a base material, such as
+// varnish on wood or the clearcoat of car paint. The coat reflects with rough
+// microfacets, and the light reaching the base is reduced by the Fresnel
+// transmission of the coat on the way in and out, and tinted by the optional
+// texture.
+type LayeredMaterial struct {
+	base            Material
+	refractiveIndex float64
+	distribution    ggx
+	tint            Texture
+}
+
+func NewLayeredMaterial(base Material, refractiveIndex float64, roughness float64, tint Texture) *LayeredMaterial {
+	return &LayeredMaterial{base, refractiveIndex, newGGX(roughness), tint}
+}
+
+// Probability of sampling the coat rather than the base
+func (self *LayeredMaterial) coatProbability(wo *Vector3) float64 {
+	return clamp(fresnelDielectric(wo.Z, self.refractiveIndex), 0.25, 0.9)
+}
+
+// Attenuation of the light going through the coat to the base and back
+func (self *LayeredMaterial) transmission(record *HitRecord, wo *Vector3, wi *Vector3) *Color {
+	t := (1.0 - fresnelDielectric(wo.Z, self.refractiveIndex)) * (1.0 - fresnelDielectric(math.Abs(wi.Z), self.refractiveIndex))
+	if self.tint == nil {
+		return NewColor(t, t, t)
+	}
+	tint := self.tint.Color(record.u, record.v, record.point)
+	return NewColor(t*tint.R, t*tint.G, t*tint.B)
+}
+
+func (self *LayeredMaterial) Scatter(rng *rand.Rand, ray *Ray, record *HitRecord) (attenuation *Color, scattered *Ray) {
+	frame := newLocalFrame(facingNormal(ray, record))
+	wo := frame.toLocal(ray.Direction.Unit().Scale(-1.0))
+	if wo.Z <= 0.0 {
+		return nil, nil
+	}
+	probability := self.coatProbability(wo)
+	var direction *Vector3
+	if rng.Float64() < probability {
+		wi := reflect(wo.Scale(-1.0), self.distribution.sampleVisibleNormal(rng, wo))
+		if wi.Z <= 0.0 {
+			return nil, nil
+		}
+		direction = frame.toWorld(wi)
+		scattered = NewRay(record.point, direction, ray.Time)
+	} else {
+		attenuation, scattered = self.base.Scatter(rng, ray, record)
+		if attenuation == nil || scattered == nil {
+			return nil, nil
+		}
+		direction = scattered.Direction.Unit()
+		if scattered.Specular || self.base.Pdf(ray, record, direction) == 0.0 {
+			// Specular base, which can't be evaluated
+			transmission := self.transmission(record, wo, frame.toLocal(direction))
+			scattered.Specular = true
+			return NewColor(attenuation.R*transmission.R/(1.0-probability),
+				attenuation.G*transmission.G/(1.0-probability),
+				attenuation.B*transmission.B/(1.0-probability)), scattered
+		}
+	}
+	pdf := self.Pdf(ray, record, direction)
+	if pdf <= 0.0 {
+		return nil, nil
+	}
+	attenuation = self.Eval(ray, record, direction)
+	attenuation.DivideAll(pdf)
+	return attenuation, scattered
+}
+
+func (self *LayeredMaterial) Emitted(record *HitRecord) *Color {
+	return self.base.Emitted(record)
+}
+
+func (self *LayeredMaterial) Eval(ray *Ray, record *HitRecord, direction *Vector3) *Color {
+	frame := newLocalFrame(facingNormal(ray, record))
+	wo := frame.toLocal(ray.Direction.Unit().Scale(-1.0))
+	wi := frame.toLocal(direction)
+	if wo.Z <= 0.0 {
+		return BlackColor
+	}
+	base := self.base.Eval(ray, record, direction)
+	transmission := self.transmission(record, wo, wi)
+	f := NewColor(base.R*transmission.R, base.G*transmission.G, base.B*transmission.B)
+	if wi.Z > 0.0 {
+		h := wo.Add(wi).Unit()
+		coat := fresnelDielectric(wo.Dot(h), self.refractiveIndex) * self.distribution.D(h) * self.distribution.G2(wo, wi) / (4.0 * wo.Z)
+		f.AddFrom(NewColor(coat, coat, coat))
+	}
+	return f
+}
+
+func (self *LayeredMaterial) Pdf(ray *Ray, record *HitRecord, direction *Vector3) float64 {
+	frame := newLocalFrame(facingNormal(ray, record))
+	wo := frame.toLocal(ray.Direction.Unit().Scale(-1.0))
+	wi := frame.toLocal(direction)
+	if wo.Z <= 0.0 {
+		return 0.0
+	}
+	probability := self.coatProbability(wo)
+	pdf := (1.0 - probability) * self.base.Pdf(ray, record, direction)
+	if wi.Z > 0.0 {
+		h := wo.Add(wi).Unit()
+		pdf += probability * self.distribution.G1(wo) * self.distribution.D(h) / (4.0 * wo.Z)
+	}
+	return pdf
+}
@@ -0,0 +1,112 @@
+package pathtracer
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Perlin gradient noise =====================================================================
+
+type Perlin struct {
+	perm [512]int
+}
+
+func NewPerlin(seed int64) *Perlin {
+	self := &Perlin{}
+	rng := rand.New(rand.NewSource(seed))
+	for i, p := range rng.Perm(256) {
+		self.perm[i] = p
+		self.perm[i+256] = p
+	}
+	return self
+}
+
+func fade(t float64) float64 {
+	return t * t * t * (t*(t*6.0-15.0) + 10.0)
+}
+
+func lerp(t float64, a float64, b float64) float64 {
+	return a + t*(b-a)
+}
+
+// Dot product of the position with one of the 12 cube edge gradients
+func grad(hash int, x float64, y float64, z float64) float64 {
+	h := hash & 15
+	u := y
+	if h < 8 {
+		u = x
+	}
+	v := z
+	if h < 4 {
+		v = y
+	} else if h == 12 || h == 14 {
+		v = x
+	}
+	if h&1 != 0 {
+		u = -u
+	}
+	if h&2 != 0 {
+		v = -v
+	}
+	return u + v
+}
+
+// Noise returns a smooth pseudo random value in [-1, 1]
+func (self *Perlin) Noise(p *Vector3) float64 {
+	fx, fy, fz := math.Floor(p.X), math.Floor(p.Y), math.Floor(p.Z)
+	x, y, z := p.X-fx, p.Y-fy, p.Z-fz
+	xi, yi, zi := int(fx)&255, int(fy)&255, int(fz)&255
+	u, v, w := fade(x), fade(y), fade(z)
+
+	perm := &self.perm
+	a := perm[xi] + yi
+	aa := perm[a] + zi
+	ab := perm[a+1] + zi
+	b := perm[xi+1] + yi
+	ba := perm[b] + zi
+	bb := perm[b+1] + zi
+
+	return lerp(w,
+		lerp(v,
+			lerp(u, grad(perm[aa], x, y, z), grad(perm[ba], x-1, y, z)),
+			lerp(u, grad(perm[ab], x, y-1, z), grad(perm[bb], x-1, y-1, z))),
+		lerp(v,
+			lerp(u, grad(perm[aa+1], x, y, z-1), grad(perm[ba+1], x-1, y, z-1)),
+			lerp(u, grad(perm[ab+1], x, y-1, z-1), grad(perm[bb+1], x-1, y-1, z-1))))
+}
+
+// FBM sums octaves of noise with halving amplitude, the result is in [-1, 1]
+func (self *Perlin) FBM(p *Vector3, octaves int) float64 {
+	sum := 0.0
+	weight := 1.0
+	total := 0.0
+	q := *p
+	for i := 0; i < octaves; i++ {
+		sum += weight * self.Noise(&q)
+		total += weight
+		weight *= 0.5
+		q = Vector3{q.X * 2.0, q.Y * 2.0, q.Z * 2.0}
+	}
+	if total == 0.0 {
+		return 0.0
+	}
+	return sum / total
+}
+
+// Turbulence sums absolute octaves of noise, the result is in [0, 1]
+func (self *Perlin) Turbulence(p *Vector3, octaves int) float64 {
+	sum := 0.0
+	weight := 1.0
+	total := 0.0
+	q := *p
+	for i := 0; i < octaves; i++ {
+		sum += weight * math.Abs(self.Noise(&q))
+		total += weight
+		weight *= 0.5
+		q = Vector3{q.X * 2.0, q.Y * 2.0, q.Z * 2.0}
+	}
+	if total == 0.0 {
+		return 0.0
+	}
+	return sum / total
+}
@@ -0,0 +1,388 @@
+package pathtracer
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Wavefront OBJ loader =====================================================================
+
+type objVertex struct {
+	vertex int
+	uv     int
+	normal int
+}
+
+func parseFloats(fields []string, count int) ([]float64, error) {
+	if len(fields) < count {
+		return nil, fmt.Errorf("expected %d values, got %d", count, len(fields))
+	}
+	values := make([]float64, count)
+	for i := 0; i < count; i++ {
+		value, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// OBJ indices are 1-based, negative ones are relative to the end of the list
+func objIndex(field string, count int) (int, error) {
+	if len(field) == 0 {
+		return -1, nil
+	}
+	index, err := strconv.Atoi(field)
+	if err != nil {
+		return -1, err
+	}
+	if index < 0 {
+		index += count
+	} else {
+		index--
+	}
+	if index < 0 || index >= count {
+		return -1, fmt.Errorf("index %s out of range", field)
+	}
+	return index, nil
+}
+
+func parseObjVertex(field string, vertexCount int, uvCount int, normalCount int) (objVertex, error) {
+	v := objVertex{-1, -1, -1}
+	parts := strings.Split(field, "/")
+	var err error
+	if v.vertex, err = objIndex(parts[0], vertexCount); err != nil {
+		return v, err
+	}
+	if v.vertex < 0 {
+		return v, fmt.Errorf("missing vertex index in '%s'", field)
+	}
+	if len(parts) > 1 {
+		if v.uv, err = objIndex(parts[1], uvCount); err != nil {
+			return v, err
+		}
+	}
+	if len(parts) > 2 {
+		if v.normal, err = objIndex(parts[2], normalCount); err != nil {
+			return v, err
+		}
+	}
+	return v, nil
+}
+
+// Ear clipping triangulation of a planar polygon, returning indices into it.
+// Ears are searched from the second vertex, so that convex polygons give the
+// same fan as most tools. Polygons without ears, which are degenerate or self
+// intersecting, are finished as fans.
+func triangulatePolygon(points []*Vector3) [][3]int {
+	// Newell's normal is robust to concave and slightly non planar polygons
+	normal := NewVector(0.0, 0.0, 0.0)
+	for i, p := range points {
+		q := points[(i+1)%len(points)]
+		normal.X += (p.Y - q.Y) * (p.Z + q.Z)
+		normal.Y += (p.Z - q.Z) * (p.X + q.X)
+		normal.Z += (p.X - q.X) * (p.Y + q.Y)
+	}
+	// Tells whether c is on the left of the edge from a to b
+	left := func(a *Vector3, b *Vector3, c *Vector3) bool {
+		return b.Subtract(a).Cross(c.Subtract(b)).Dot(normal) > 0.0
+	}
+	remaining := make([]int, len(points))
+	for i := range remaining {
+		remaining[i] = i
+	}
+	triangles := [][3]int{}
+	for len(remaining) > 3 {
+		n := len(remaining)
+		ear := -1
+		for k := 1; k <= n && ear < 0; k++ {
+			i := k % n
+			a, b, c := points[remaining[(i+n-1)%n]], points[remaining[i]], points[remaining[(i+1)%n]]
+			if !left(a, b, c) {
+				continue
+			}
+			ear = i
+			for _, j := range remaining {
+				p := points[j]
+				if p == a || p == b || p == c || *p == *a || *p == *b || *p == *c {
+					continue
+				}
+				if !left(b, a, p) && !left(c, b, p) && !left(a, c, p) {
+					ear = -1
+					break
+				}
+			}
+		}
+		if ear < 0 {
+			break
+		}
+		triangles = append(triangles, [3]int{remaining[(ear+n-1)%n], remaining[ear], remaining[(ear+1)%n]})
+		remaining = append(remaining[:ear], remaining[ear+1:]...)
+	}
+	for i := 1; i+1 < len(remaining); i++ {
+		triangles = append(triangles, [3]int{remaining[0], remaining[i], remaining[i+1]})
+	}
+	return triangles
+}
+
+// LoadOBJ reads a Wavefront OBJ file into a mesh. Polygons, which may be
+// concave, are triangulated by ear clipping. Faces using a material from the
+// referenced .mtl files get that material, the others use the given default
+// material.
+func LoadOBJ(filename string, material Material) (*Mesh, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	vertices := []*Vector3{}
+	normals := []*Vector3{}
+	uvs := []*Vector3{}
+	faces := []MeshFace{}
+	materials := make(map[string]Material)
+	currentMaterial := material
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if comment := strings.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "v":
+			values, err := parseFloats(fields[1:], 3)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", filename, lineNumber, err)
+			}
+			vertices = append(vertices, NewVector(values[0], values[1], values[2]))
+			break
+		case "vn":
+			values, err := parseFloats(fields[1:], 3)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", filename, lineNumber, err)
+			}
+			// Null normals are kept, faces using them fall back to their
+			// geometric normal
+			normal := NewVector(values[0], values[1], values[2])
+			if normal.SquaredLength() != 0.0 {
+				normal = normal.Unit()
+			}
+			normals = append(normals, normal)
+			break
+		case "vt":
+			values, err := parseFloats(fields[1:], 1)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", filename, lineNumber, err)
+			}
+			v := 0.0
+			if len(fields) > 2 {
+				if v, err = strconv.ParseFloat(fields[2], 64); err != nil {
+					return nil, fmt.Errorf("%s:%d: %v", filename, lineNumber, err)
+				}
+			}
+			uvs = append(uvs, NewVector(values[0], v, 0.0))
+			break
+		case "f":
+			if len(fields) < 4 {
+				return nil, fmt.Errorf("%s:%d: face with less than 3 vertices", filename, lineNumber)
+			}
+			polygon := make([]objVertex, len(fields)-1)
+			points := make([]*Vector3, len(polygon))
+			for i, field := range fields[1:] {
+				v, err := parseObjVertex(field, len(vertices), len(uvs), len(normals))
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: %v", filename, lineNumber, err)
+				}
+				polygon[i] = v
+				points[i] = vertices[v.vertex]
+			}
+			for _, triangle := range triangulatePolygon(points) {
+				face := MeshFace{Material: currentMaterial}
+				for j, v := range [3]objVertex{polygon[triangle[0]], polygon[triangle[1]], polygon[triangle[2]]} {
+					face.Vertices[j] = v.vertex
+					face.UVs[j] = v.uv
+					face.Normals[j] = v.normal
+				}
+				faces = append(faces, face)
+			}
+			break
+		case "mtllib":
+			for _, name := range fields[1:] {
+				err := loadMTL(resolvePath(filename, name), materials)
+				if err != nil {
+					fmt.Printf("Unable to load material library: %v\n", err)
+				}
+			}
+			break
+		case "usemtl":
+			currentMaterial = material
+			if len(fields) > 1 {
+				if mtl, ok := materials[fields[1]]; ok {
+					currentMaterial = mtl
+				} else {
+					fmt.Printf("OBJ material not found: '%s'\n", fields[1])
+				}
+			}
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, face := range faces {
+		if face.Material == nil {
+			return nil, fmt.Errorf("%s: faces without material", filename)
+		}
+	}
+
+	return NewMesh(vertices, normals, uvs, faces, material), nil
+}
+
+// MTL material library ==========================================================
+
+type mtlMaterial struct {
+	diffuse         [3]float64
+	specular        [3]float64
+	emission        [3]float64
+	transmission    [3]float64
+	specularExp     float64
+	refractiveIndex float64
+	dissolve        float64
+	illum           int
+	diffuseMap      string
+}
+
+// The MTL Phong-like description is mapped onto the closest existing material:
+// emitting surfaces become lights, transparent ones dielectrics, specular ones
+// metals and the rest Lambert.
+func (self *mtlMaterial) material() Material {
+	if self.emission[0] > 0.0 || self.emission[1] > 0.0 || self.emission[2] > 0.0 {
+		return NewEmissiveMaterial(NewStaticTexture(NewColor(self.emission[0], self.emission[1], self.emission[2])), 1.0)
+	}
+	if self.dissolve < 1.0 || self.illum == 4 || self.illum == 6 || self.illum == 7 || self.illum == 9 {
+		refractiveIndex := self.refractiveIndex
+		if refractiveIndex <= 1.0 {
+			refractiveIndex = 1.5
+		}
+		var tint Texture
+		if self.transmission != [3]float64{1.0, 1.0, 1.0} {
+			tint = NewStaticTexture(NewColor(self.transmission[0], self.transmission[1], self.transmission[2]))
+		}
+		return NewDielectricMaterial(refractiveIndex, tint, nil, nil, nil)
+	}
+	specular := math.Max(self.specular[0], math.Max(self.specular[1], self.specular[2]))
+	diffuse := math.Max(self.diffuse[0], math.Max(self.diffuse[1], self.diffuse[2]))
+	if specular > diffuse {
+		// Phong exponent to roughness approximation
+		fuzziness := math.Sqrt(2.0 / (self.specularExp + 2.0))
+		return NewMetalMaterial(NewStaticTexture(NewColor(self.specular[0], self.specular[1], self.specular[2])), fuzziness, nil)
+	}
+	if len(self.diffuseMap) != 0 {
+		texture, err := LoadImageTexture(self.diffuseMap, WrapRepeat)
+		if err == nil {
+			return NewLambertMaterial(texture)
+		}
+		fmt.Printf("Unable to load texture: %v\n", err)
+	}
+	return NewLambertMaterial(NewStaticTexture(NewColor(self.diffuse[0], self.diffuse[1], self.diffuse[2])))
+}
+
+func loadMTL(filename string, materials map[string]Material) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var current *mtlMaterial
+	var currentName string
+	flush := func() {
+		if current != nil {
+			materials[currentName] = current.material()
+		}
+	}
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if comment := strings.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "newmtl" {
+			flush()
+			current = &mtlMaterial{diffuse: [3]float64{0.8, 0.8, 0.8}, transmission: [3]float64{1.0, 1.0, 1.0}, specularExp: 10.0, refractiveIndex: 1.0, dissolve: 1.0}
+			currentName = strings.Join(fields[1:], " ")
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		switch fields[0] {
+		case "Kd", "Ks", "Ke", "Tf":
+			values, err := parseFloats(fields[1:], 3)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %v", filename, lineNumber, err)
+			}
+			switch fields[0] {
+			case "Kd":
+				copy(current.diffuse[:], values)
+			case "Ks":
+				copy(current.specular[:], values)
+			case "Ke":
+				copy(current.emission[:], values)
+			case "Tf":
+				copy(current.transmission[:], values)
+			}
+			break
+		case "Ns", "Ni", "d", "Tr":
+			values, err := parseFloats(fields[1:], 1)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %v", filename, lineNumber, err)
+			}
+			switch fields[0] {
+			case "Ns":
+				current.specularExp = values[0]
+			case "Ni":
+				current.refractiveIndex = values[0]
+			case "d":
+				current.dissolve = values[0]
+			case "Tr":
+				current.dissolve = 1.0 - values[0]
+			}
+			break
+		case "map_Kd":
+			// Options such as -s or -o are not supported, the file name is the last field
+			if len(fields) > 1 {
+				current.diffuseMap = resolvePath(filename, fields[len(fields)-1])
+			}
+			break
+		case "illum":
+			if len(fields) > 1 {
+				if illum, err := strconv.Atoi(fields[1]); err == nil {
+					current.illum = illum
+				}
+			}
+			break
+		}
+	}
+	flush()
+	return scanner.Err()
+}
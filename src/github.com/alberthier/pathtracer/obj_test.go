@@ -0,0 +1,52 @@
+package pathtracer
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTriangulatePolygon(t *testing.T) {
+	tests := []struct {
+		name   string
+		points [][3]float64
+		area   float64
+	}{
+		{"triangle", [][3]float64{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}}, 0.5},
+		{"square", [][3]float64{{0, 0, 0}, {1, 0, 0}, {1, 1, 0}, {0, 1, 0}}, 1.0},
+		{"L shape", [][3]float64{{0, 0, 0}, {2, 0, 0}, {2, 1, 0}, {1, 1, 0}, {1, 2, 0}, {0, 2, 0}}, 3.0},
+		// Concave at the second vertex, where a fan would start
+		{"arrow", [][3]float64{{0, 0, 0}, {1, 1, 0}, {2, 0, 0}, {1, 3, 0}}, 2.0},
+		{"clockwise star", [][3]float64{{0, 3, 1}, {1, 1, 1}, {3, 1, 1}, {1, 0, 1}, {2, -2, 1}, {0, -1, 1}, {-2, -2, 1}, {-1, 0, 1}, {-3, 1, 1}, {-1, 1, 1}}, 10.0},
+	}
+	for _, test := range tests {
+		points := newVectors(test.points)
+		triangles := triangulatePolygon(points)
+		if len(triangles) != len(points)-2 {
+			t.Errorf("%s: got %d triangles, want %d", test.name, len(triangles), len(points)-2)
+			continue
+		}
+		// Triangles keep the polygon orientation, so their areas only add up
+		// to the polygon area when none overlaps or is flipped
+		var normal *Vector3
+		area := 0.0
+		for _, triangle := range triangles {
+			n := points[triangle[1]].Subtract(points[triangle[0]]).Cross(points[triangle[2]].Subtract(points[triangle[0]]))
+			if normal == nil {
+				normal = n.Unit()
+			}
+			area += 0.5 * n.Dot(normal)
+		}
+		if math.Abs(area-test.area) > 1e-9 {
+			t.Errorf("%s: triangles %v cover %v, want %v", test.name, triangles, area, test.area)
+		}
+	}
+
+	// Convex polygons are fans, as triangulated by most tools
+	triangles := triangulatePolygon(newVectors([][3]float64{{0, 0, 0}, {1, 0, 0}, {2, 1, 0}, {1, 2, 0}, {0, 1, 0}}))
+	for i, triangle := range triangles {
+		if triangle != [3]int{0, i + 1, i + 2} {
+			t.Errorf("convex polygon: got %v", triangles)
+			break
+		}
+	}
+}
@@ -1,22 +1,73 @@
 package pathtracer
 
-import "math"
+import (
+	"math"
+	"math/rand"
+)
 
 type HitRecord struct {
 	t      float64
 	point  *Vector3
 	normal *Vector3
+	u      float64
+	v      float64
 	object SceneObject
+	// Outermost object hit, a whole mesh rather than one of its triangles
+	root SceneObject
 }
 
+// SceneObject is anything which can be hit. Hits record the primitive which
+// was hit, whose material GetMaterial returns. Groups, which only gather other
+// objects and are never recorded, have no material and return nil.
 type SceneObject interface {
 	HitBy(ray *Ray, tmin float64, tmax float64, record *HitRecord) bool
 	GetMaterial() Material
-	Update(t float64)
+	Update(t0 float64, t1 float64)
+	BoundingBox() *AABB
+	GetTransform() *Transform
+	SetTransform(transform *Transform)
 }
 
+// SampledObject is implemented by objects which can be used as area lights.
+// Directions are unit vectors and pdfs are expressed in solid angle as seen
+// from the origin at the given time.
+type SampledObject interface {
+	SampleDirection(rng *rand.Rand, origin *Vector3, time float64) (direction *Vector3, pdf float64)
+	DirectionPdf(origin *Vector3, direction *Vector3, time float64) float64
+}
+
+// Aggregate is implemented by objects made of several primitives, so that
+// emissive ones can be sampled as lights
+type Aggregate interface {
+	Primitives() []SceneObject
+}
+
+// Medium is implemented by participating media. Transmittance is the fraction
+// of light going through the medium along the ray between tmin and tmax.
+type Medium interface {
+	Transmittance(rng *rand.Rand, ray *Ray, tmin float64, tmax float64) float64
+}
+
+// ObjectBase holds the placement common to all objects. The optional
+// transform maps the object space, in which HitBy works, to world space.
 type ObjectBase struct {
-	Position AnimatedVector
+	Position  AnimatedVector
+	Transform *Transform
+}
+
+func (self *ObjectBase) GetTransform() *Transform {
+	return self.Transform
+}
+
+func (self *ObjectBase) SetTransform(transform *Transform) {
+	self.Transform = transform
+}
+
+// sweptBox bounds an object of the given half extent around its position
+// during the whole shutter interval
+func (self *ObjectBase) sweptBox(extent *Vector3) *AABB {
+	bounds := self.Position.Bounds()
+	return NewAABB(bounds.Min.Subtract(extent), bounds.Max.Add(extent))
 }
 
 type Sphere struct {
@@ -27,15 +78,24 @@ type Sphere struct {
 
 func NewSphere(position AnimatedVector, radius AnimatedValue, material Material) *Sphere {
 	return &Sphere{
-		ObjectBase{position},
+		ObjectBase{Position: position},
 		radius, material}
 }
 
+// Spherical mapping of a unit vector: u goes around the Y axis starting from
+// -X, v from the bottom to the top pole
+func sphereUV(p *Vector3) (float64, float64) {
+	theta := math.Acos(math.Max(-1.0, math.Min(1.0, -p.Y)))
+	phi := math.Atan2(-p.Z, p.X) + math.Pi
+	return phi / (2.0 * math.Pi), theta / math.Pi
+}
+
 func (self *Sphere) HitBy(ray *Ray, tmin float64, tmax float64, record *HitRecord) bool {
-	oc := ray.Origin.Subtract(self.Position.Get())
+	center := self.Position.At(ray.Time)
+	radius := self.Radius.At(ray.Time)
+	oc := ray.Origin.Subtract(center)
 	a := ray.Direction.Dot(ray.Direction)
 	b := oc.Dot(ray.Direction)
-	radius := self.Radius.Get()
 	c := oc.Dot(oc) - radius*radius
 	disc := b*b - a*c
 	if disc > 0 {
@@ -47,20 +107,224 @@ func (self *Sphere) HitBy(ray *Ray, tmin float64, tmax float64, record *HitRecor
 				return false
 			}
 		}
-		record.t = t
-		record.point = ray.PointAt(t)
-		record.normal = record.point.Subtract(self.Position.Get()).Scale(1.0 / radius)
-		record.object = self
+		self.fillRecord(ray, t, center, radius, record)
 		return true
 	}
 	return false
 }
 
+func (self *Sphere) fillRecord(ray *Ray, t float64, center *Vector3, radius float64, record *HitRecord) {
+	record.t = t
+	record.point = ray.PointAt(t)
+	record.normal = record.point.Subtract(center).Scale(1.0 / radius)
+	record.u, record.v = sphereUV(record.point.Subtract(center).Scale(1.0 / math.Abs(radius)))
+	record.object = self
+}
+
+func (self *Sphere) Spans(ray *Ray) []Span {
+	center := self.Position.At(ray.Time)
+	radius := self.Radius.At(ray.Time)
+	oc := ray.Origin.Subtract(center)
+	a := ray.Direction.Dot(ray.Direction)
+	b := oc.Dot(ray.Direction)
+	c := oc.Dot(oc) - radius*radius
+	disc := b*b - a*c
+	if disc <= 0 {
+		return nil
+	}
+	sd := math.Sqrt(disc)
+	var span Span
+	self.fillRecord(ray, (-b-sd)/a, center, radius, &span.Enter)
+	self.fillRecord(ray, (-b+sd)/a, center, radius, &span.Exit)
+	return []Span{span}
+}
+
 func (self *Sphere) GetMaterial() Material {
 	return self.Material
 }
 
-func (self *Sphere) Update(t float64) {
-	self.Position.Update(t)
-	self.Radius.Update(t)
+func (self *Sphere) Update(t0 float64, t1 float64) {
+	self.Position.Update(t0, t1)
+	self.Radius.Update(t0, t1)
+}
+
+// Uniform sampling of the cone of directions subtended by the sphere
+func (self *Sphere) SampleDirection(rng *rand.Rand, origin *Vector3, time float64) (direction *Vector3, pdf float64) {
+	toCenter := self.Position.At(time).Subtract(origin)
+	cosMax := self.cosMax(toCenter, self.Radius.At(time))
+	if cosMax < 0.0 {
+		return nil, 0.0
+	}
+	w := toCenter.Unit()
+	u, v := w.OrthonormalBasis()
+	z := 1.0 + rng.Float64()*(cosMax-1.0)
+	phi := 2.0 * math.Pi * rng.Float64()
+	r := math.Sqrt(math.Max(0.0, 1.0-z*z))
+	direction = u.Scale(r * math.Cos(phi)).Add(v.Scale(r * math.Sin(phi))).Add(w.Scale(z))
+	return direction, 1.0 / (2.0 * math.Pi * (1.0 - cosMax))
+}
+
+// Zero for directions outside the cone, which miss the sphere
+func (self *Sphere) DirectionPdf(origin *Vector3, direction *Vector3, time float64) float64 {
+	toCenter := self.Position.At(time).Subtract(origin)
+	cosMax := self.cosMax(toCenter, self.Radius.At(time))
+	if cosMax < 0.0 || direction.Dot(toCenter.Unit()) < cosMax {
+		return 0.0
+	}
+	return 1.0 / (2.0 * math.Pi * (1.0 - cosMax))
+}
+
+// Cosine of the half angle of the cone subtended by the sphere, negative when
+// the origin is inside it
+func (self *Sphere) cosMax(toCenter *Vector3, radius float64) float64 {
+	sin2 := radius * radius / toCenter.SquaredLength()
+	if sin2 >= 1.0 {
+		return -1.0
+	}
+	return math.Sqrt(1.0 - sin2)
+}
+
+func (self *Sphere) BoundingBox() *AABB {
+	lo, hi := self.Radius.Range()
+	radius := math.Max(math.Abs(lo), math.Abs(hi))
+	return self.sweptBox(NewVector(radius, radius, radius))
+}
+
+// Triangle =====================================================================
+
+type Triangle struct {
+	ObjectBase
+	Vertices [3]*Vector3
+	Normals  [3]*Vector3
+	UVs      [3]*Vector3
+	Material Material
+	edge1    *Vector3
+	edge2    *Vector3
+	normal   *Vector3
+	epsilon  float64
+}
+
+// Triangles whose vertices are aligned have neither area nor normal
+func isDegenerate(v0 *Vector3, v1 *Vector3, v2 *Vector3) bool {
+	return areParallel(v1.Subtract(v0), v2.Subtract(v0))
+}
+
+// Edges are parallel when the sine of their angle vanishes, relative to their
+// lengths so that it holds at any scale, or when one of them is null
+func areParallel(edge1 *Vector3, edge2 *Vector3) bool {
+	return edge1.Cross(edge2).Length() <= 1e-9*edge1.Length()*edge2.Length()
+}
+
+func NewTriangle(v0 *Vector3, v1 *Vector3, v2 *Vector3, material Material) *Triangle {
+	self := &Triangle{}
+	self.Vertices = [3]*Vector3{v0, v1, v2}
+	self.Material = material
+	self.edge1 = v1.Subtract(v0)
+	self.edge2 = v2.Subtract(v0)
+	self.normal = self.edge1.Cross(self.edge2).Unit()
+	self.epsilon = 1e-12 * self.edge1.Length() * self.edge2.Length()
+	return self
+}
+
+// Triangles with a null vertex normal keep their geometric normal
+func (self *Triangle) SetNormals(n0 *Vector3, n1 *Vector3, n2 *Vector3) {
+	if n0.SquaredLength() == 0.0 || n1.SquaredLength() == 0.0 || n2.SquaredLength() == 0.0 {
+		return
+	}
+	self.Normals = [3]*Vector3{n0, n1, n2}
+}
+
+func (self *Triangle) SetUVs(uv0 *Vector3, uv1 *Vector3, uv2 *Vector3) {
+	self.UVs = [3]*Vector3{uv0, uv1, uv2}
+}
+
+// Barycentric interpolation of per-vertex attributes
+func interpolate(values [3]*Vector3, b1 float64, b2 float64) *Vector3 {
+	return values[0].Scale(1.0 - b1 - b2).Add(values[1].Scale(b1)).Add(values[2].Scale(b2))
+}
+
+func (self *Triangle) HitBy(ray *Ray, tmin float64, tmax float64, record *HitRecord) bool {
+	// Möller-Trumbore intersection
+	p := ray.Direction.Cross(self.edge2)
+	det := self.edge1.Dot(p)
+	// Rays parallel to the triangle, relative to the edge and direction lengths
+	if det*det < self.epsilon*self.epsilon*ray.Direction.SquaredLength() {
+		return false
+	}
+	invDet := 1.0 / det
+	s := ray.Origin.Subtract(self.Vertices[0])
+	b1 := s.Dot(p) * invDet
+	if b1 < 0.0 || b1 > 1.0 {
+		return false
+	}
+	q := s.Cross(self.edge1)
+	b2 := ray.Direction.Dot(q) * invDet
+	if b2 < 0.0 || b1+b2 > 1.0 {
+		return false
+	}
+	t := self.edge2.Dot(q) * invDet
+	if t <= tmin || tmax <= t {
+		return false
+	}
+	record.t = t
+	record.point = ray.PointAt(t)
+	record.normal = self.normal
+	// Opposite vertex normals may cancel out
+	if self.Normals[0] != nil {
+		if normal := interpolate(self.Normals, b1, b2); normal.SquaredLength() != 0.0 {
+			record.normal = normal.Unit()
+		}
+	}
+	if self.UVs[0] != nil {
+		uv := interpolate(self.UVs, b1, b2)
+		record.u, record.v = uv.X, uv.Y
+	} else {
+		record.u, record.v = b1, b2
+	}
+	record.object = self
+	return true
+}
+
+func (self *Triangle) GetMaterial() Material {
+	return self.Material
+}
+
+func (self *Triangle) Update(t0 float64, t1 float64) {
+}
+
+func (self *Triangle) area() float64 {
+	return 0.5 * self.edge1.Cross(self.edge2).Length()
+}
+
+// Area sampling, converted to solid angle
+func (self *Triangle) SampleDirection(rng *rand.Rand, origin *Vector3, time float64) (direction *Vector3, pdf float64) {
+	su := math.Sqrt(rng.Float64())
+	b1 := su * (1.0 - rng.Float64())
+	b2 := su - b1
+	point := self.Vertices[0].Add(self.edge1.Scale(b1)).Add(self.edge2.Scale(b2))
+	toPoint := point.Subtract(origin)
+	distance2 := toPoint.SquaredLength()
+	direction = toPoint.Scale(1.0 / math.Sqrt(distance2))
+	cosine := math.Abs(direction.Dot(self.normal))
+	if cosine < 1e-8 {
+		return nil, 0.0
+	}
+	return direction, distance2 / (cosine * self.area())
+}
+
+func (self *Triangle) DirectionPdf(origin *Vector3, direction *Vector3, time float64) float64 {
+	record := HitRecord{}
+	if !self.HitBy(NewRay(origin, direction, time), 0.0, math.MaxFloat64, &record) {
+		return 0.0
+	}
+	cosine := math.Abs(direction.Dot(self.normal))
+	if cosine < 1e-8 {
+		return 0.0
+	}
+	return record.t * record.t / (cosine * self.area())
+}
+
+func (self *Triangle) BoundingBox() *AABB {
+	box := NewAABB(self.Vertices[0], self.Vertices[0])
+	return box.Extend(self.Vertices[1]).Extend(self.Vertices[2]).Pad(1e-6)
 }
@@ -0,0 +1,130 @@
+package pathtracer
+
+import (
+	"math"
+	"sort"
+)
+
+// Polynomial root finding, after Jochen Schwarze's Graphics Gems solver.
+// Coefficients are given from the highest degree down and real roots are
+// returned in increasing order.
+
+const polynomialEpsilon = 1e-12
+
+func isZero(x float64) bool {
+	return x > -polynomialEpsilon && x < polynomialEpsilon
+}
+
+// Solves a x^2 + b x + c = 0
+func solveQuadratic(a float64, b float64, c float64) []float64 {
+	if isZero(a) {
+		if isZero(b) {
+			return nil
+		}
+		return []float64{-c / b}
+	}
+	p := b / (2.0 * a)
+	q := c / a
+	d := p*p - q
+	if isZero(d) {
+		return []float64{-p}
+	} else if d < 0.0 {
+		return nil
+	}
+	sqrtD := math.Sqrt(d)
+	return []float64{-sqrtD - p, sqrtD - p}
+}
+
+// Solves a x^3 + b x^2 + c x + d = 0
+func solveCubic(a float64, b float64, c float64, d float64) []float64 {
+	if isZero(a) {
+		return solveQuadratic(b, c, d)
+	}
+	// Normal form x^3 + A x^2 + B x + C = 0, then substitute x = y - A/3
+	A, B, C := b/a, c/a, d/a
+	sqA := A * A
+	p := (-sqA/3.0 + B) / 3.0
+	q := (2.0/27.0*A*sqA - A*B/3.0 + C) / 2.0
+	cbP := p * p * p
+	D := q*q + cbP
+
+	var roots []float64
+	if isZero(D) {
+		if isZero(q) {
+			roots = []float64{0.0}
+		} else {
+			u := math.Cbrt(-q)
+			roots = []float64{2.0 * u, -u}
+		}
+	} else if D < 0.0 {
+		// Three real roots
+		phi := math.Acos(-q/math.Sqrt(-cbP)) / 3.0
+		t := 2.0 * math.Sqrt(-p)
+		roots = []float64{t * math.Cos(phi), -t * math.Cos(phi+math.Pi/3.0), -t * math.Cos(phi-math.Pi/3.0)}
+	} else {
+		sqrtD := math.Sqrt(D)
+		roots = []float64{math.Cbrt(sqrtD-q) - math.Cbrt(sqrtD+q)}
+	}
+	for i := range roots {
+		roots[i] -= A / 3.0
+	}
+	sort.Float64s(roots)
+	return roots
+}
+
+// Solves a x^4 + b x^3 + c x^2 + d x + e = 0
+func solveQuartic(a float64, b float64, c float64, d float64, e float64) []float64 {
+	if isZero(a) {
+		return solveCubic(b, c, d, e)
+	}
+	// Normal form x^4 + A x^3 + B x^2 + C x + D = 0, then substitute x = y - A/4
+	A, B, C, D := b/a, c/a, d/a, e/a
+	sqA := A * A
+	p := -3.0/8.0*sqA + B
+	q := 1.0/8.0*sqA*A - 1.0/2.0*A*B + C
+	r := -3.0/256.0*sqA*sqA + 1.0/16.0*sqA*B - 1.0/4.0*A*C + D
+
+	var roots []float64
+	if isZero(r) {
+		// y (y^3 + p y + q) = 0
+		roots = append(solveCubic(1.0, 0.0, p, q), 0.0)
+	} else {
+		// With z the largest root of the resolvent cubic, v^2 = 2 z - p >= 0 and
+		// y^4 + p y^2 + q y + r = (y^2 - v y + z + w) (y^2 + v y + z - w)
+		// where w = q / 2v
+		resolvent := solveCubic(1.0, -1.0/2.0*p, -r, 1.0/2.0*r*p-1.0/8.0*q*q)
+		z := resolvent[len(resolvent)-1]
+		v := math.Sqrt(math.Max(0.0, 2.0*z-p))
+		if v > 1e-9 {
+			w := q / (2.0 * v)
+			roots = append(solveQuadratic(1.0, -v, z+w), solveQuadratic(1.0, v, z-w)...)
+		} else {
+			// Biquadratic y^4 + p y^2 + r = 0
+			for _, y2 := range solveQuadratic(1.0, p, r) {
+				if y2 >= 0.0 {
+					roots = append(roots, -math.Sqrt(y2), math.Sqrt(y2))
+				}
+			}
+		}
+	}
+	for i := range roots {
+		roots[i] -= A / 4.0
+		// Newton iterations polish the precision lost in the reduction
+		x := roots[i]
+		for j := 0; j < 8; j++ {
+			f := (((a*x+b)*x+c)*x+d)*x + e
+			df := ((4.0*a*x+3.0*b)*x+2.0*c)*x + d
+			if isZero(df) {
+				break
+			}
+			step := f / df
+			x -= step
+			if math.Abs(step) < 1e-12*(1.0+math.Abs(x)) {
+				break
+			}
+		}
+		roots[i] = x
+	}
+	sort.Float64s(roots)
+	return roots
+}
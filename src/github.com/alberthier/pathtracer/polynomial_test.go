@@ -0,0 +1,100 @@
+package pathtracer
+
+import (
+	"math"
+	"sort"
+	"testing"
+)
+
+// Coefficients of scale times the product of (x - root) and of the quadratic
+// factors, from the highest degree down
+func expandPolynomial(scale float64, roots []float64, quadratics [][2]float64) []float64 {
+	coefficients := []float64{scale}
+	multiply := func(factor []float64) {
+		product := make([]float64, len(coefficients)+len(factor)-1)
+		for i, a := range coefficients {
+			for j, b := range factor {
+				product[i+j] += a * b
+			}
+		}
+		coefficients = product
+	}
+	for _, root := range roots {
+		multiply([]float64{1.0, -root})
+	}
+	for _, quadratic := range quadratics {
+		multiply([]float64{1.0, quadratic[0], quadratic[1]})
+	}
+	return coefficients
+}
+
+func checkRoots(t *testing.T, name string, got []float64, want []float64) {
+	sorted := append([]float64{}, want...)
+	sort.Float64s(sorted)
+	if len(got) != len(sorted) {
+		t.Errorf("%s: got roots %v, want %v", name, got, sorted)
+		return
+	}
+	for i := range got {
+		if math.Abs(got[i]-sorted[i]) > 1e-6*math.Max(1.0, math.Abs(sorted[i])) {
+			t.Errorf("%s: got roots %v, want %v", name, got, sorted)
+			return
+		}
+	}
+}
+
+func TestSolveQuadratic(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b, c float64
+		want    []float64
+	}{
+		{"two roots", 2.0, -2.0, -12.0, []float64{-2.0, 3.0}},
+		{"double root", 1.0, -4.0, 4.0, []float64{2.0}},
+		{"no real root", 1.0, 0.0, 1.0, nil},
+		{"linear", 0.0, 2.0, -1.0, []float64{0.5}},
+		{"constant", 0.0, 0.0, 1.0, nil},
+	}
+	for _, test := range tests {
+		checkRoots(t, test.name, solveQuadratic(test.a, test.b, test.c), test.want)
+	}
+}
+
+func TestSolveCubic(t *testing.T) {
+	tests := []struct {
+		name       string
+		scale      float64
+		roots      []float64
+		quadratics [][2]float64
+	}{
+		{"three roots", 1.0, []float64{-2.0, 0.5, 3.0}, nil},
+		{"one real root", -3.0, []float64{1.5}, [][2]float64{{0.0, 1.0}}},
+		{"root at zero", 2.0, []float64{0.0, -1.0, 4.0}, nil},
+	}
+	for _, test := range tests {
+		c := expandPolynomial(test.scale, test.roots, test.quadratics)
+		checkRoots(t, test.name, solveCubic(c[0], c[1], c[2], c[3]), test.roots)
+	}
+}
+
+func TestSolveQuartic(t *testing.T) {
+	tests := []struct {
+		name       string
+		scale      float64
+		roots      []float64
+		quadratics [][2]float64
+	}{
+		{"four roots", 1.0, []float64{-3.0, -1.0, 0.5, 2.0}, nil},
+		{"scaled", -0.25, []float64{-10.0, -0.1, 0.2, 7.0}, nil},
+		{"two roots", 2.0, []float64{-1.0, 4.0}, [][2]float64{{1.0, 1.0}}},
+		{"no real root", 1.0, nil, [][2]float64{{0.0, 1.0}, {-2.0, 5.0}}},
+		{"biquadratic", 1.0, []float64{-2.0, -1.0, 1.0, 2.0}, nil},
+		{"root at zero", 1.0, []float64{0.0, 1.0, 2.0, 3.0}, nil},
+		// Torus along its axis of symmetry, major radius 2 and minor 0.5
+		{"torus", 1.0, []float64{-2.5, -1.5, 1.5, 2.5}, nil},
+	}
+	for _, test := range tests {
+		c := expandPolynomial(test.scale, test.roots, test.quadratics)
+		checkRoots(t, test.name, solveQuartic(c[0], c[1], c[2], c[3], c[4]), test.roots)
+	}
+}
@@ -0,0 +1,328 @@
+package pathtracer
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// Parameter is a scalar material input, either constant or read from the
+// average of a texture's channels
+type Parameter struct {
+	Value   float64
+	Texture Texture
+}
+
+func NewParameter(value float64, texture Texture) Parameter {
+	return Parameter{value, texture}
+}
+
+func (self Parameter) Get(record *HitRecord) float64 {
+	if self.Texture == nil {
+		return self.Value
+	}
+	color := self.Texture.Color(record.u, record.v, record.point)
+	return (color.R + color.G + color.B) / 3.0
+}
+
+// Principled =====================================================================
+
+// PrincipledMaterial follows the Disney principled BSDF: a Burley diffuse
+// and sheen base, a GGX specular lobe blended towards the base color by the
+// metallic parameter, a GTR1 clearcoat and a rough dielectric transmission
+// lobe. Refraction into the object is tinted by the base color.
+type PrincipledMaterial struct {
+	MaterialBase
+	baseColor      Texture
+	metallic       Parameter
+	roughness      Parameter
+	specular       Parameter
+	specularTint   Parameter
+	sheen          Parameter
+	sheenTint      Parameter
+	clearcoat      Parameter
+	clearcoatGloss Parameter
+	transmission   Parameter
+	ior            Parameter
+}
+
+func NewPrincipledMaterial(baseColor Texture, metallic Parameter, roughness Parameter, specular Parameter, specularTint Parameter,
+	sheen Parameter, sheenTint Parameter, clearcoat Parameter, clearcoatGloss Parameter, transmission Parameter, ior Parameter) *PrincipledMaterial {
+	return &PrincipledMaterial{
+		baseColor:      baseColor,
+		metallic:       metallic,
+		roughness:      roughness,
+		specular:       specular,
+		specularTint:   specularTint,
+		sheen:          sheen,
+		sheenTint:      sheenTint,
+		clearcoat:      clearcoat,
+		clearcoatGloss: clearcoatGloss,
+		transmission:   transmission,
+		ior:            ior,
+	}
+}
+
+// Parameters are constants unless the textures map of the material names a
+// texture for them
+func newPrincipledMaterial(data *FileMaterial, textures *map[string]Texture) Material {
+	valid := true
+	parameter := func(name string, value float64) Parameter {
+		textureName, ok := data.Textures[name]
+		if !ok {
+			return NewParameter(value, nil)
+		}
+		texture := (*textures)[textureName]
+		if texture == nil {
+			fmt.Printf("Unknown texture for %s: '%s'\n", name, textureName)
+			valid = false
+		}
+		return NewParameter(value, texture)
+	}
+	optional := func(value *float64, defaultValue float64) float64 {
+		if value == nil {
+			return defaultValue
+		}
+		return *value
+	}
+
+	var baseColor Texture
+	if textureName, ok := data.Textures["baseColor"]; ok {
+		baseColor = (*textures)[textureName]
+	} else if len(data.Texture) != 0 {
+		baseColor = (*textures)[data.Texture]
+	} else if data.Color != nil {
+		baseColor = NewStaticTexture(NewColor(data.Color[0], data.Color[1], data.Color[2]))
+	} else {
+		baseColor = NewStaticTexture(NewColor(0.8, 0.8, 0.8))
+	}
+	if baseColor == nil {
+		fmt.Printf("Unknown base color texture for material '%s'\n", data.Name)
+		return nil
+	}
+
+	material := NewPrincipledMaterial(baseColor,
+		parameter("metallic", data.Metallic),
+		parameter("roughness", data.Roughness),
+		parameter("specular", optional(data.Specular, 0.5)),
+		parameter("specularTint", data.SpecularTint),
+		parameter("sheen", data.Sheen),
+		parameter("sheenTint", data.SheenTint),
+		parameter("clearcoat", data.Clearcoat),
+		parameter("clearcoatGloss", optional(data.ClearcoatGloss, 1.0)),
+		parameter("transmission", data.Transmission),
+		parameter("ior", optional(data.Ior, 1.5)))
+	if !valid {
+		return nil
+	}
+	return material
+}
+
+// Fifth power Fresnel weight
+func schlickWeight(cosine float64) float64 {
+	m := math.Max(0.0, math.Min(1.0, 1.0-cosine))
+	m2 := m * m
+	return m2 * m2 * m
+}
+
+func lerpColor(t float64, a *Color, b *Color) *Color {
+	return NewColor(lerp(t, a.R, b.R), lerp(t, a.G, b.G), lerp(t, a.B, b.B))
+}
+
+// Relative luminance based tint, the hue and saturation of the base color
+func colorTint(base *Color) *Color {
+	luminance := 0.3*base.R + 0.6*base.G + 0.1*base.B
+	if luminance <= 0.0 {
+		return NewColor(1.0, 1.0, 1.0)
+	}
+	return NewColor(base.R/luminance, base.G/luminance, base.B/luminance)
+}
+
+// Berry distribution used by the clearcoat lobe
+func gtr1(cosine float64, alpha float64) float64 {
+	a2 := alpha * alpha
+	t := 1.0 + (a2-1.0)*cosine*cosine
+	return (a2 - 1.0) / (math.Pi * math.Log(a2) * t)
+}
+
+// principledLobes holds the parameters evaluated at a hit point
+type principledLobes struct {
+	frame          localFrame
+	eta            float64
+	inside         bool
+	base           *Color
+	roughness      float64
+	specularColor  *Color
+	sheenColor     *Color
+	distribution   ggx
+	clearcoat      float64
+	clearcoatAlpha float64
+	// Lobe weights
+	diffuseWeight      float64
+	specularWeight     float64
+	transmissionWeight float64
+	// Lobe selection probabilities
+	diffuseProbability      float64
+	specularProbability     float64
+	clearcoatProbability    float64
+	transmissionProbability float64
+}
+
+func (self *PrincipledMaterial) lobes(ray *Ray, record *HitRecord) *principledLobes {
+	lobes := &principledLobes{}
+	base := self.baseColor.Color(record.u, record.v, record.point)
+	metallic := math.Max(0.0, math.Min(1.0, self.metallic.Get(record)))
+	transmission := math.Max(0.0, math.Min(1.0, self.transmission.Get(record)))
+	ior := self.ior.Get(record)
+	lobes.base = base
+	lobes.roughness = math.Max(0.0, math.Min(1.0, self.roughness.Get(record)))
+	lobes.distribution = newGGX(lobes.roughness)
+	lobes.diffuseWeight = (1.0 - metallic) * (1.0 - transmission)
+	lobes.transmissionWeight = (1.0 - metallic) * transmission
+
+	// Transmissive materials are seen from inside as pure rough dielectrics
+	lobes.inside = ray.Direction.Dot(record.normal) > 0.0
+	if lobes.inside && lobes.transmissionWeight > 0.0 {
+		lobes.frame = newLocalFrame(record.normal.Scale(-1.0))
+		lobes.eta = 1.0 / ior
+		lobes.transmissionWeight = 1.0
+		lobes.transmissionProbability = 1.0
+		return lobes
+	}
+	lobes.frame = newLocalFrame(facingNormal(ray, record))
+	lobes.eta = ior
+
+	tint := colorTint(base)
+	specular := 0.08 * self.specular.Get(record)
+	specularTint := lerpColor(self.specularTint.Get(record), NewColor(1.0, 1.0, 1.0), tint)
+	specularTint.MultiplyAll(specular)
+	lobes.specularColor = lerpColor(metallic, specularTint, base)
+	lobes.sheenColor = lerpColor(self.sheenTint.Get(record), NewColor(1.0, 1.0, 1.0), tint)
+	lobes.sheenColor.MultiplyAll(self.sheen.Get(record))
+	lobes.specularWeight = 1.0 - lobes.transmissionWeight
+	lobes.clearcoat = 0.25 * math.Max(0.0, self.clearcoat.Get(record))
+	lobes.clearcoatAlpha = lerp(self.clearcoatGloss.Get(record), 0.1, 0.001)
+
+	total := lobes.diffuseWeight + lobes.specularWeight + lobes.clearcoat + lobes.transmissionWeight
+	if total > 0.0 {
+		lobes.diffuseProbability = lobes.diffuseWeight / total
+		lobes.specularProbability = lobes.specularWeight / total
+		lobes.clearcoatProbability = lobes.clearcoat / total
+		lobes.transmissionProbability = lobes.transmissionWeight / total
+	}
+	return lobes
+}
+
+// Returns the BSDF times the cosine and the combined pdf of all the lobes,
+// in the local frame
+func (self *principledLobes) evalPdf(wo *Vector3, wi *Vector3) (*Color, float64) {
+	f := NewColor(0.0, 0.0, 0.0)
+	pdf := 0.0
+	if wo.Z <= 0.0 {
+		return f, pdf
+	}
+	if self.transmissionProbability > 0.0 {
+		t, tpdf := evalRoughDielectric(self.distribution, wo, wi, self.eta)
+		t *= self.transmissionWeight
+		if wi.Z < 0.0 && !self.inside {
+			f.AddFrom(NewColor(t*self.base.R, t*self.base.G, t*self.base.B))
+		} else {
+			f.AddFrom(NewColor(t, t, t))
+		}
+		pdf += self.transmissionProbability * tpdf
+	}
+	if wi.Z <= 0.0 || self.transmissionProbability == 1.0 {
+		return f, pdf
+	}
+
+	h := wo.Add(wi).Unit()
+	cosD := wi.Dot(h)
+	if self.diffuseWeight > 0.0 {
+		// Burley diffuse with retro-reflection, and sheen at grazing angles
+		fl := schlickWeight(wi.Z)
+		fv := schlickWeight(wo.Z)
+		fd90 := 0.5 + 2.0*self.roughness*cosD*cosD
+		diffuse := (1.0 + (fd90-1.0)*fl) * (1.0 + (fd90-1.0)*fv) / math.Pi
+		sheen := schlickWeight(cosD)
+		w := self.diffuseWeight * wi.Z
+		f.AddFrom(NewColor(w*(diffuse*self.base.R+sheen*self.sheenColor.R),
+			w*(diffuse*self.base.G+sheen*self.sheenColor.G),
+			w*(diffuse*self.base.B+sheen*self.sheenColor.B)))
+		pdf += self.diffuseProbability * wi.Z / math.Pi
+	}
+	if self.specularWeight > 0.0 {
+		d := self.distribution
+		fh := schlickWeight(cosD)
+		s := self.specularWeight * d.D(h) * d.G2(wo, wi) / (4.0 * wo.Z)
+		f.AddFrom(NewColor(s*lerp(fh, self.specularColor.R, 1.0),
+			s*lerp(fh, self.specularColor.G, 1.0),
+			s*lerp(fh, self.specularColor.B, 1.0)))
+		pdf += self.specularProbability * d.G1(wo) * d.D(h) / (4.0 * wo.Z)
+	}
+	if self.clearcoat > 0.0 {
+		d := gtr1(h.Z, self.clearcoatAlpha)
+		g := newGGX(0.5).G2(wo, wi)
+		c := self.clearcoat * lerp(schlickWeight(cosD), 0.04, 1.0) * d * g / (4.0 * wo.Z)
+		f.AddFrom(NewColor(c, c, c))
+		pdf += self.clearcoatProbability * d * h.Z / (4.0 * cosD)
+	}
+	return f, pdf
+}
+
+// Samples one lobe, the weight accounts for all of them
+func (self *principledLobes) sample(rng *rand.Rand, wo *Vector3) *Vector3 {
+	u := rng.Float64()
+	if u < self.transmissionProbability {
+		return sampleRoughDielectric(rng, self.distribution, wo, self.eta)
+	}
+	u -= self.transmissionProbability
+	var wi *Vector3
+	if u < self.diffuseProbability {
+		r := math.Sqrt(rng.Float64())
+		phi := 2.0 * math.Pi * rng.Float64()
+		wi = NewVector(r*math.Cos(phi), r*math.Sin(phi), math.Sqrt(math.Max(0.0, 1.0-r*r)))
+	} else if u < self.diffuseProbability+self.specularProbability {
+		wi = reflect(wo.Scale(-1.0), self.distribution.sampleVisibleNormal(rng, wo))
+	} else {
+		a2 := self.clearcoatAlpha * self.clearcoatAlpha
+		cosTheta := math.Sqrt(math.Max(0.0, (1.0-math.Pow(a2, 1.0-rng.Float64()))/(1.0-a2)))
+		sinTheta := math.Sqrt(math.Max(0.0, 1.0-cosTheta*cosTheta))
+		phi := 2.0 * math.Pi * rng.Float64()
+		h := NewVector(sinTheta*math.Cos(phi), sinTheta*math.Sin(phi), cosTheta)
+		wi = reflect(wo.Scale(-1.0), h)
+	}
+	if wi.Z <= 0.0 {
+		return nil
+	}
+	return wi
+}
+
+func (self *PrincipledMaterial) Scatter(rng *rand.Rand, ray *Ray, record *HitRecord) (attenuation *Color, scattered *Ray) {
+	lobes := self.lobes(ray, record)
+	wo := lobes.frame.toLocal(ray.Direction.Unit().Scale(-1.0))
+	if wo.Z <= 0.0 {
+		return nil, nil
+	}
+	wi := lobes.sample(rng, wo)
+	if wi == nil {
+		return nil, nil
+	}
+	f, pdf := lobes.evalPdf(wo, wi)
+	if pdf <= 0.0 {
+		return nil, nil
+	}
+	f.DivideAll(pdf)
+	return f, NewRay(record.point, lobes.frame.toWorld(wi), ray.Time)
+}
+
+func (self *PrincipledMaterial) Eval(ray *Ray, record *HitRecord, direction *Vector3) *Color {
+	lobes := self.lobes(ray, record)
+	f, _ := lobes.evalPdf(lobes.frame.toLocal(ray.Direction.Unit().Scale(-1.0)), lobes.frame.toLocal(direction))
+	return f
+}
+
+func (self *PrincipledMaterial) Pdf(ray *Ray, record *HitRecord, direction *Vector3) float64 {
+	lobes := self.lobes(ray, record)
+	_, pdf := lobes.evalPdf(lobes.frame.toLocal(ray.Direction.Unit().Scale(-1.0)), lobes.frame.toLocal(direction))
+	return pdf
+}
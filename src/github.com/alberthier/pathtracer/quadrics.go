@@ -0,0 +1,321 @@
+package pathtracer
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Quadric and quartic primitives are defined around the Y axis, starting at
+// their position. Other orientations are obtained with transforms.
+
+// Angle around the Y axis mapped to [0, 1]
+func azimuthUV(x float64, z float64) float64 {
+	return (math.Atan2(-z, x) + math.Pi) / (2.0 * math.Pi)
+}
+
+// Intersection of the ray with the horizontal disk of the given radius at
+// height y above the center
+func hitDisk(ray *Ray, center *Vector3, y float64, radius float64, tmin float64, tmax float64) (float64, bool) {
+	if math.Abs(ray.Direction.Y) < 1e-12 {
+		return 0.0, false
+	}
+	t := (center.Y + y - ray.Origin.Y) / ray.Direction.Y
+	if t <= tmin || tmax <= t {
+		return 0.0, false
+	}
+	x := ray.Origin.X + t*ray.Direction.X - center.X
+	z := ray.Origin.Z + t*ray.Direction.Z - center.Z
+	if x*x+z*z > radius*radius {
+		return 0.0, false
+	}
+	return t, true
+}
+
+// Disk =====================================================================
+
+type Disk struct {
+	ObjectBase
+	Radius   float64
+	Material Material
+}
+
+func NewDisk(position AnimatedVector, radius float64, material Material) *Disk {
+	return &Disk{ObjectBase{Position: position}, radius, material}
+}
+
+func (self *Disk) HitBy(ray *Ray, tmin float64, tmax float64, record *HitRecord) bool {
+	center := self.Position.At(ray.Time)
+	t, ok := hitDisk(ray, center, 0.0, self.Radius, tmin, tmax)
+	if !ok {
+		return false
+	}
+	record.t = t
+	record.point = ray.PointAt(t)
+	record.normal = NewVector(0.0, 1.0, 0.0)
+	local := record.point.Subtract(center)
+	record.u = azimuthUV(local.X, local.Z)
+	record.v = math.Sqrt(local.X*local.X+local.Z*local.Z) / self.Radius
+	record.object = self
+	return true
+}
+
+func (self *Disk) GetMaterial() Material {
+	return self.Material
+}
+
+func (self *Disk) Update(t0 float64, t1 float64) {
+	self.Position.Update(t0, t1)
+}
+
+func (self *Disk) BoundingBox() *AABB {
+	return self.sweptBox(NewVector(self.Radius, 0.0, self.Radius)).Pad(1e-6)
+}
+
+// Area sampling, converted to solid angle
+func (self *Disk) SampleDirection(rng *rand.Rand, origin *Vector3, time float64) (direction *Vector3, pdf float64) {
+	r := self.Radius * math.Sqrt(rng.Float64())
+	phi := 2.0 * math.Pi * rng.Float64()
+	point := self.Position.At(time).Add(NewVector(r*math.Cos(phi), 0.0, r*math.Sin(phi)))
+	toPoint := point.Subtract(origin)
+	distance2 := toPoint.SquaredLength()
+	direction = toPoint.Scale(1.0 / math.Sqrt(distance2))
+	cosine := math.Abs(direction.Y)
+	if cosine < 1e-8 {
+		return nil, 0.0
+	}
+	return direction, distance2 / (cosine * math.Pi * self.Radius * self.Radius)
+}
+
+func (self *Disk) DirectionPdf(origin *Vector3, direction *Vector3, time float64) float64 {
+	t, ok := hitDisk(NewRay(origin, direction, time), self.Position.At(time), 0.0, self.Radius, 0.0, math.MaxFloat64)
+	cosine := math.Abs(direction.Y)
+	if !ok || cosine < 1e-8 {
+		return 0.0
+	}
+	return t * t / (cosine * math.Pi * self.Radius * self.Radius)
+}
+
+// Cylinder =====================================================================
+
+type Cylinder struct {
+	ObjectBase
+	Radius   float64
+	Height   float64
+	Capped   bool
+	Material Material
+}
+
+func NewCylinder(position AnimatedVector, radius float64, height float64, capped bool, material Material) *Cylinder {
+	return &Cylinder{ObjectBase{Position: position}, radius, height, capped, material}
+}
+
+func (self *Cylinder) HitBy(ray *Ray, tmin float64, tmax float64, record *HitRecord) bool {
+	center := self.Position.At(ray.Time)
+	ox := ray.Origin.X - center.X
+	oz := ray.Origin.Z - center.Z
+	a := ray.Direction.X*ray.Direction.X + ray.Direction.Z*ray.Direction.Z
+	b := ox*ray.Direction.X + oz*ray.Direction.Z
+	c := ox*ox + oz*oz - self.Radius*self.Radius
+	hit := false
+	if a > 1e-12 {
+		disc := b*b - a*c
+		if disc > 0.0 {
+			sd := math.Sqrt(disc)
+			for _, t := range [2]float64{(-b - sd) / a, (-b + sd) / a} {
+				if t <= tmin || tmax <= t {
+					continue
+				}
+				y := ray.Origin.Y + t*ray.Direction.Y - center.Y
+				if y < 0.0 || y > self.Height {
+					continue
+				}
+				record.t = t
+				record.point = ray.PointAt(t)
+				record.normal = NewVector((record.point.X-center.X)/self.Radius, 0.0, (record.point.Z-center.Z)/self.Radius)
+				record.u = azimuthUV(record.normal.X, record.normal.Z)
+				record.v = y / self.Height
+				tmax = t
+				hit = true
+				break
+			}
+		}
+	}
+	if self.Capped {
+		for _, y := range [2]float64{0.0, self.Height} {
+			if t, ok := hitDisk(ray, center, y, self.Radius, tmin, tmax); ok {
+				record.t = t
+				record.point = ray.PointAt(t)
+				if y == 0.0 {
+					record.normal = NewVector(0.0, -1.0, 0.0)
+				} else {
+					record.normal = NewVector(0.0, 1.0, 0.0)
+				}
+				record.u = 0.5 + 0.5*(record.point.X-center.X)/self.Radius
+				record.v = 0.5 + 0.5*(record.point.Z-center.Z)/self.Radius
+				tmax = t
+				hit = true
+			}
+		}
+	}
+	if hit {
+		record.object = self
+	}
+	return hit
+}
+
+func (self *Cylinder) GetMaterial() Material {
+	return self.Material
+}
+
+func (self *Cylinder) Update(t0 float64, t1 float64) {
+	self.Position.Update(t0, t1)
+}
+
+func (self *Cylinder) BoundingBox() *AABB {
+	box := self.sweptBox(NewVector(self.Radius, 0.0, self.Radius))
+	box.Max.Y += self.Height
+	return box
+}
+
+// Cone =====================================================================
+
+// Cone has its base on its position and its apex at its height
+type Cone struct {
+	ObjectBase
+	Radius   float64
+	Height   float64
+	Capped   bool
+	Material Material
+}
+
+func NewCone(position AnimatedVector, radius float64, height float64, capped bool, material Material) *Cone {
+	return &Cone{ObjectBase{Position: position}, radius, height, capped, material}
+}
+
+func (self *Cone) HitBy(ray *Ray, tmin float64, tmax float64, record *HitRecord) bool {
+	// x^2 + z^2 = k^2 (h - y)^2 with k = r / h
+	center := self.Position.At(ray.Time)
+	k := self.Radius / self.Height
+	k2 := k * k
+	ox := ray.Origin.X - center.X
+	oz := ray.Origin.Z - center.Z
+	oy := self.Height - (ray.Origin.Y - center.Y)
+	d := ray.Direction
+	a := d.X*d.X + d.Z*d.Z - k2*d.Y*d.Y
+	b := ox*d.X + oz*d.Z + k2*oy*d.Y
+	c := ox*ox + oz*oz - k2*oy*oy
+	hit := false
+	for _, t := range solveQuadratic(a, 2.0*b, c) {
+		if t <= tmin || tmax <= t {
+			continue
+		}
+		y := ray.Origin.Y + t*d.Y - center.Y
+		if y < 0.0 || y > self.Height {
+			continue
+		}
+		record.t = t
+		record.point = ray.PointAt(t)
+		px := record.point.X - center.X
+		pz := record.point.Z - center.Z
+		record.normal = NewVector(px, k*math.Sqrt(px*px+pz*pz), pz).Unit()
+		record.u = azimuthUV(px, pz)
+		record.v = y / self.Height
+		tmax = t
+		hit = true
+		break
+	}
+	if self.Capped {
+		if t, ok := hitDisk(ray, center, 0.0, self.Radius, tmin, tmax); ok {
+			record.t = t
+			record.point = ray.PointAt(t)
+			record.normal = NewVector(0.0, -1.0, 0.0)
+			record.u = 0.5 + 0.5*(record.point.X-center.X)/self.Radius
+			record.v = 0.5 + 0.5*(record.point.Z-center.Z)/self.Radius
+			hit = true
+		}
+	}
+	if hit {
+		record.object = self
+	}
+	return hit
+}
+
+func (self *Cone) GetMaterial() Material {
+	return self.Material
+}
+
+func (self *Cone) Update(t0 float64, t1 float64) {
+	self.Position.Update(t0, t1)
+}
+
+func (self *Cone) BoundingBox() *AABB {
+	box := self.sweptBox(NewVector(self.Radius, 0.0, self.Radius))
+	box.Max.Y += self.Height
+	return box
+}
+
+// Torus =====================================================================
+
+// Torus lies in the XZ plane: its tube of minor radius turns around the Y
+// axis at the major radius
+type Torus struct {
+	ObjectBase
+	MajorRadius float64
+	MinorRadius float64
+	Material    Material
+}
+
+func NewTorus(position AnimatedVector, majorRadius float64, minorRadius float64, material Material) *Torus {
+	return &Torus{ObjectBase{Position: position}, majorRadius, minorRadius, material}
+}
+
+func (self *Torus) HitBy(ray *Ray, tmin float64, tmax float64, record *HitRecord) bool {
+	// Solved along the normalized direction for a better conditioned quartic
+	center := self.Position.At(ray.Time)
+	length := ray.Direction.Length()
+	d := ray.Direction.Scale(1.0 / length)
+	o := ray.Origin.Subtract(center)
+	R2 := self.MajorRadius * self.MajorRadius
+	r2 := self.MinorRadius * self.MinorRadius
+	e := o.Dot(o) - R2 - r2
+	f := o.Dot(d)
+	roots := solveQuartic(1.0,
+		4.0*f,
+		2.0*e+4.0*f*f+4.0*R2*d.Y*d.Y,
+		4.0*f*e+8.0*R2*o.Y*d.Y,
+		e*e-4.0*R2*(r2-o.Y*o.Y))
+	for _, s := range roots {
+		t := s / length
+		if t <= tmin || tmax <= t {
+			continue
+		}
+		point := ray.PointAt(t)
+		p := point.Subtract(center)
+		ring := math.Sqrt(p.X*p.X + p.Z*p.Z)
+		if ring < 1e-12 {
+			continue
+		}
+		record.t = t
+		record.point = point
+		onRing := NewVector(p.X*self.MajorRadius/ring, 0.0, p.Z*self.MajorRadius/ring)
+		record.normal = p.Subtract(onRing).Unit()
+		record.u = azimuthUV(p.X, p.Z)
+		record.v = (math.Atan2(p.Y, ring-self.MajorRadius) + math.Pi) / (2.0 * math.Pi)
+		record.object = self
+		return true
+	}
+	return false
+}
+
+func (self *Torus) GetMaterial() Material {
+	return self.Material
+}
+
+func (self *Torus) Update(t0 float64, t1 float64) {
+	self.Position.Update(t0, t1)
+}
+
+func (self *Torus) BoundingBox() *AABB {
+	extent := self.MajorRadius + self.MinorRadius
+	return self.sweptBox(NewVector(extent, self.MinorRadius, extent))
+}
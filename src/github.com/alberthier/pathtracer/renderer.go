@@ -2,7 +2,6 @@ package pathtracer
 
 import (
 	"fmt"
-	"image"
 	"math"
 	"math/rand"
 	"runtime"
@@ -18,15 +17,21 @@ type Color struct {
 }
 
 var WhiteColor = NewColor(1.0, 1.0, 1.0)
+var BlackColor = NewColor(0.0, 0.0, 0.0)
 
 func NewColor(r float64, g float64, b float64) *Color {
 	return &Color{r, g, b}
 }
 
+func clamp(value float64, min float64, max float64) float64 {
+	return math.Max(min, math.Min(max, value))
+}
+
+// RGBA clamps components to [0, 1], radiance above 1.0 can't be represented
 func (self *Color) RGBA() (r uint32, g uint32, b uint32, a uint32) {
-	return uint32(self.R * 0xffff),
-		uint32(self.G * 0xffff),
-		uint32(self.B * 0xffff),
+	return uint32(clamp(self.R, 0.0, 1.0) * 0xffff),
+		uint32(clamp(self.G, 0.0, 1.0) * 0xffff),
+		uint32(clamp(self.B, 0.0, 1.0) * 0xffff),
 		0xffff
 }
 
@@ -36,27 +41,46 @@ func (self *Color) AddFrom(other *Color) {
 	self.B += other.B
 }
 
+func (self *Color) MultiplyAll(val float64) {
+	self.R *= val
+	self.G *= val
+	self.B *= val
+}
+
+func (self *Color) IsBlack() bool {
+	return self.R == 0.0 && self.G == 0.0 && self.B == 0.0
+}
+
 func (self *Color) DivideAll(val float64) {
 	self.R /= val
 	self.G /= val
 	self.B /= val
 }
 
-func (self *Color) GammaCorrect() {
-	self.R = math.Sqrt(self.R)
-	self.G = math.Sqrt(self.G)
-	self.B = math.Sqrt(self.B)
-}
-
 // ===================== Ray
 
+// Ray time is used to evaluate animations within the shutter interval.
+// Media sample their collisions with the random generator of the path. Rays
+// without generator, such as shadow rays, go through media.
+// In spectral mode, rays have the hero wavelength of their path. Paths which
+// went through a dispersive material are monochromatic, only their hero
+// wavelength is carried.
+// Composite materials flag the rays they scattered with a specular component,
+// whose direction can't be evaluated by their Pdf.
 type Ray struct {
-	Origin    *Vector3
-	Direction *Vector3
+	Origin        *Vector3
+	Direction     *Vector3
+	Time          float64
+	Wavelength    float64
+	Monochromatic bool
+	Specular      bool
+	Rng           *rand.Rand
+	// Absorbing dielectrics the ray travels in, the innermost last
+	Interior []*DielectricMaterial
 }
 
-func NewRay(origin *Vector3, direction *Vector3) *Ray {
-	return &Ray{origin, direction}
+func NewRay(origin *Vector3, direction *Vector3, time float64) *Ray {
+	return &Ray{Origin: origin, Direction: direction, Time: time}
 }
 
 func (self *Ray) PointAt(t float64) *Vector3 {
@@ -75,45 +99,95 @@ type Renderer struct {
 	width        int
 	height       int
 	samplesPerPx int
+	spectral     bool
 }
 
-func NewRenderer(width int, height int, samplesPerPx int) *Renderer {
-	return &Renderer{width, height, samplesPerPx}
+func NewRenderer(width int, height int, samplesPerPx int, spectral bool) *Renderer {
+	return &Renderer{width, height, samplesPerPx, spectral}
 }
 
-func (self *Renderer) background(ray *Ray) *Color {
-	udir := ray.Direction.Unit()
-	t := 0.5 * (udir.Y + 1.0)
-	return NewColor((1-t)+t*0.5,
-		(1-t)+t*0.7,
-		(1-t)+t*1.0)
+func (self *Renderer) Color(rng *rand.Rand, ray *Ray, world *World, depth int) *Color {
+	return self.trace(rng, ray, world, depth, 0.0)
 }
 
-func (self *Renderer) Color(rng *rand.Rand, ray *Ray, world *World, depth int) *Color {
+// Power heuristic for multiple importance sampling
+func powerHeuristic(pdf float64, otherPdf float64) float64 {
+	pdf2 := pdf * pdf
+	return pdf2 / (pdf2 + otherPdf*otherPdf)
+}
+
+// Direct lighting from a point on a light, weighted against material sampling
+func (self *Renderer) sampleLight(rng *rand.Rand, ray *Ray, record *HitRecord, material Material, world *World) *Color {
+	light, direction, lightPdf := world.SampleLight(rng, record.point, ray.Time)
+	if light == nil {
+		return BlackColor
+	}
+	f := ray.spectrum(material.Eval(ray, record, direction))
+	if f.IsBlack() {
+		return BlackColor
+	}
+	shadowRecord := HitRecord{}
+	visibility := world.Visibility(rng, NewRay(record.point, direction, ray.Time), light, &shadowRecord)
+	if visibility == 0.0 {
+		return BlackColor
+	}
+	emitted := ray.spectrum(light.object.GetMaterial().Emitted(&shadowRecord))
+	weight := visibility * powerHeuristic(lightPdf, material.Pdf(ray, record, direction)) / lightPdf
+	// The shadow ray leaves on the side the ray came from, in the same media
+	return absorbed(ray, shadowRecord.t, NewColor(f.R*emitted.R*weight, f.G*emitted.G*weight, f.B*emitted.B*weight))
+}
+
+// Light reaching the ray origin from the point at t, through the dielectric
+// the ray travels in
+func absorbed(ray *Ray, t float64, color *Color) *Color {
+	if len(ray.Interior) == 0 {
+		return color
+	}
+	absorption := ray.spectrum(ray.absorption(t))
+	return NewColor(color.R*absorption.R, color.G*absorption.G, color.B*absorption.B)
+}
+
+// bsdfPdf is the pdf with which the material sampled the ray direction, zero
+// for camera rays and specular bounces whose emission can't be light sampled
+func (self *Renderer) trace(rng *rand.Rand, ray *Ray, world *World, depth int, bsdfPdf float64) *Color {
 	record := HitRecord{}
-	tmax := math.MaxFloat64
-	hitSomething := false
-	for _, obj := range world.Scene.Objects {
-		hit := obj.HitBy(ray, 0.001, tmax, &record)
-		if hit {
-			hitSomething = true
-			tmax = record.t
-		}
+	if !world.HitBy(ray, 0.001, math.MaxFloat64, &record) {
+		return ray.spectrum(world.Background.Color(ray))
 	}
-	if hitSomething {
-		if depth < 50 {
-			attenuation, scattered := record.object.GetMaterial().Scatter(rng, ray, &record)
-			if attenuation != nil && scattered != nil {
-				color := self.Color(rng, scattered, world, depth+1)
-				return NewColor(attenuation.R*color.R,
-					attenuation.G*color.G,
-					attenuation.B*color.B)
-			}
+	material := record.object.GetMaterial()
+	emitted := ray.spectrum(material.Emitted(&record))
+	color := NewColor(emitted.R, emitted.G, emitted.B)
+	if bsdfPdf > 0.0 && !emitted.IsBlack() {
+		lightPdf := world.LightPdf(&record, ray.Origin, ray.Direction.Unit(), ray.Time)
+		color.MultiplyAll(powerHeuristic(bsdfPdf, lightPdf))
+	}
+	if depth >= 50 {
+		return absorbed(ray, record.t, color)
+	}
+
+	color.AddFrom(self.sampleLight(rng, ray, &record, material, world))
+
+	attenuation, scattered := material.Scatter(rng, ray, &record)
+	if attenuation != nil && scattered != nil {
+		attenuation = ray.spectrum(attenuation)
+		scattered.Wavelength = ray.Wavelength
+		scattered.Rng = rng
+		if scattered.Monochromatic && !ray.Monochromatic {
+			// The companion wavelengths are dropped, the hero stands for all
+			attenuation = NewColor(3.0*attenuation.R, 0.0, 0.0)
 		}
-		return NewColor(0.0, 0.0, 0.0)
-	} else {
-		return self.background(ray)
+		scattered.Monochromatic = scattered.Monochromatic || ray.Monochromatic
+		scattered.Interior = scatteredInterior(material, ray, scattered, &record)
+		pdf := 0.0
+		if !scattered.Specular {
+			pdf = material.Pdf(ray, &record, scattered.Direction.Unit())
+		}
+		indirect := self.trace(rng, scattered, world, depth+1, pdf)
+		color.AddFrom(NewColor(attenuation.R*indirect.R,
+			attenuation.G*indirect.G,
+			attenuation.B*indirect.B))
 	}
+	return absorbed(ray, record.t, color)
 }
 
 func (self *Renderer) renderLine(channel chan *PixelColor, world *World, line int) {
@@ -127,21 +201,27 @@ func (self *Renderer) renderLine(channel chan *PixelColor, world *World, line in
 			u := (float64(i) + rng.Float64()) / fwidth
 			v := (float64(line) + rng.Float64()) / fheight
 			ray := world.Scene.Camera.GetRay(rng, u, v)
-			color.AddFrom(self.Color(rng, ray, world, 0))
+			ray.Rng = rng
+			if self.spectral {
+				ray.Wavelength = sampleWavelength(rng)
+				color.AddFrom(spectrumToRGB(self.Color(rng, ray, world, 0), ray.Wavelength))
+			} else {
+				color.AddFrom(self.Color(rng, ray, world, 0))
+			}
 		}
 		color.DivideAll(float64(self.samplesPerPx))
-		color.GammaCorrect()
 
 		channel <- &PixelColor{i, self.height - line - 1, color}
 	}
 	channel <- &PixelColor{0, 0, nil}
 }
 
-func (self *Renderer) Render(world *World, t float64, logprefix string) image.Image {
+// Render returns the linear radiance of the frame at time t
+func (self *Renderer) Render(world *World, t float64, logprefix string) *FloatImage {
 	maxGoRoutines := runtime.NumCPU()
 	goRoutinesCount := 0
 
-	img := image.NewRGBA(image.Rect(0, 0, self.width, self.height))
+	img := NewFloatImage(self.width, self.height)
 
 	channel := make(chan *PixelColor, 100)
 
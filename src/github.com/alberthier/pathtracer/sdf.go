@@ -0,0 +1,380 @@
+package pathtracer
+
+import (
+	"fmt"
+	"math"
+)
+
+// SignedDistance is a node of a signed distance field tree, negative inside
+// the shape. Bounds are relative to the object position and nil when the
+// field is unbounded.
+type SignedDistance interface {
+	Distance(p Vector3) float64
+	Bounds() *AABB
+}
+
+func NewSignedDistance(data *FileSdf) SignedDistance {
+	center := Vector3{data.Center[0], data.Center[1], data.Center[2]}
+	children := []SignedDistance{}
+	for i := range data.Children {
+		child := NewSignedDistance(&data.Children[i])
+		if child == nil {
+			return nil
+		}
+		children = append(children, child)
+	}
+	switch data.Type {
+	case "sphere":
+		return &sdfSphere{center, data.Radius}
+	case "box":
+		return &sdfBox{center, Vector3{data.Size[0], data.Size[1], data.Size[2]}, 0.0}
+	case "roundbox":
+		return &sdfBox{center, Vector3{data.Size[0], data.Size[1], data.Size[2]}, data.Radius}
+	case "torus":
+		return &sdfTorus{center, data.Radius, data.MinorRadius}
+	case "capsule":
+		return &sdfCapsule{Vector3{data.A[0], data.A[1], data.A[2]}, Vector3{data.B[0], data.B[1], data.B[2]}, data.Radius}
+	case "union", "subtraction":
+		if len(children) < 2 {
+			fmt.Printf("SDF %s needs at least 2 children\n", data.Type)
+			return nil
+		}
+		// More than 2 children are combined from left to right
+		node := children[0]
+		for _, child := range children[1:] {
+			if data.Type == "union" {
+				node = &sdfUnion{node, child, data.Smooth}
+			} else {
+				node = &sdfSubtraction{node, child, data.Smooth}
+			}
+		}
+		return node
+	case "twist", "repeat":
+		if len(children) != 1 {
+			fmt.Printf("SDF %s needs exactly 1 child\n", data.Type)
+			return nil
+		}
+		if data.Type == "twist" {
+			return newSdfTwist(children[0], data.Rate)
+		}
+		return &sdfRepeat{children[0], Vector3{data.Period[0], data.Period[1], data.Period[2]}, data.Count}
+	}
+	fmt.Printf("Unknown SDF node type: '%s'\n", data.Type)
+	return nil
+}
+
+func vectorLength(v Vector3) float64 {
+	return math.Sqrt(v.X*v.X + v.Y*v.Y + v.Z*v.Z)
+}
+
+func sdfAABB(center Vector3, extent Vector3) *AABB {
+	return &AABB{
+		Vector3{center.X - extent.X, center.Y - extent.Y, center.Z - extent.Z},
+		Vector3{center.X + extent.X, center.Y + extent.Y, center.Z + extent.Z}}
+}
+
+func growAABB(box *AABB, delta float64) *AABB {
+	return &AABB{
+		Vector3{box.Min.X - delta, box.Min.Y - delta, box.Min.Z - delta},
+		Vector3{box.Max.X + delta, box.Max.Y + delta, box.Max.Z + delta}}
+}
+
+// Smooth minimum with a polynomial blend of width k
+func smoothMin(a float64, b float64, k float64) float64 {
+	if k <= 0.0 {
+		return math.Min(a, b)
+	}
+	h := math.Max(k-math.Abs(a-b), 0.0) / k
+	return math.Min(a, b) - h*h*k*0.25
+}
+
+// Primitives =====================================================================
+
+type sdfSphere struct {
+	center Vector3
+	radius float64
+}
+
+func (self *sdfSphere) Distance(p Vector3) float64 {
+	return vectorLength(Vector3{p.X - self.center.X, p.Y - self.center.Y, p.Z - self.center.Z}) - self.radius
+}
+
+func (self *sdfSphere) Bounds() *AABB {
+	return sdfAABB(self.center, Vector3{self.radius, self.radius, self.radius})
+}
+
+// Box of the given half size, with edges rounded by the radius
+type sdfBox struct {
+	center   Vector3
+	size     Vector3
+	rounding float64
+}
+
+func (self *sdfBox) Distance(p Vector3) float64 {
+	qx := math.Abs(p.X-self.center.X) - self.size.X + self.rounding
+	qy := math.Abs(p.Y-self.center.Y) - self.size.Y + self.rounding
+	qz := math.Abs(p.Z-self.center.Z) - self.size.Z + self.rounding
+	outside := vectorLength(Vector3{math.Max(qx, 0.0), math.Max(qy, 0.0), math.Max(qz, 0.0)})
+	inside := math.Min(math.Max(qx, math.Max(qy, qz)), 0.0)
+	return outside + inside - self.rounding
+}
+
+func (self *sdfBox) Bounds() *AABB {
+	return sdfAABB(self.center, self.size)
+}
+
+// Torus around the Y axis, as the torus object
+type sdfTorus struct {
+	center      Vector3
+	majorRadius float64
+	minorRadius float64
+}
+
+func (self *sdfTorus) Distance(p Vector3) float64 {
+	x := p.X - self.center.X
+	z := p.Z - self.center.Z
+	ring := math.Sqrt(x*x+z*z) - self.majorRadius
+	y := p.Y - self.center.Y
+	return math.Sqrt(ring*ring+y*y) - self.minorRadius
+}
+
+func (self *sdfTorus) Bounds() *AABB {
+	extent := self.majorRadius + self.minorRadius
+	return sdfAABB(self.center, Vector3{extent, self.minorRadius, extent})
+}
+
+// Segment between a and b, thickened by the radius
+type sdfCapsule struct {
+	a      Vector3
+	b      Vector3
+	radius float64
+}
+
+func (self *sdfCapsule) Distance(p Vector3) float64 {
+	pa := Vector3{p.X - self.a.X, p.Y - self.a.Y, p.Z - self.a.Z}
+	ba := Vector3{self.b.X - self.a.X, self.b.Y - self.a.Y, self.b.Z - self.a.Z}
+	h := 0.0
+	if length2 := ba.Dot(&ba); length2 > 0.0 {
+		h = math.Max(0.0, math.Min(1.0, pa.Dot(&ba)/length2))
+	}
+	return vectorLength(Vector3{pa.X - ba.X*h, pa.Y - ba.Y*h, pa.Z - ba.Z*h}) - self.radius
+}
+
+func (self *sdfCapsule) Bounds() *AABB {
+	r := Vector3{self.radius, self.radius, self.radius}
+	return sdfAABB(self.a, r).Union(sdfAABB(self.b, r))
+}
+
+// Operators =====================================================================
+
+type sdfUnion struct {
+	left   SignedDistance
+	right  SignedDistance
+	smooth float64
+}
+
+func (self *sdfUnion) Distance(p Vector3) float64 {
+	return smoothMin(self.left.Distance(p), self.right.Distance(p), self.smooth)
+}
+
+func (self *sdfUnion) Bounds() *AABB {
+	left := self.left.Bounds()
+	right := self.right.Bounds()
+	if left == nil || right == nil {
+		return nil
+	}
+	// The blend adds at most a quarter of its width
+	return growAABB(left.Union(right), self.smooth*0.25)
+}
+
+// Subtraction removes the right shape from the left one
+type sdfSubtraction struct {
+	left   SignedDistance
+	right  SignedDistance
+	smooth float64
+}
+
+func (self *sdfSubtraction) Distance(p Vector3) float64 {
+	return -smoothMin(-self.left.Distance(p), self.right.Distance(p), self.smooth)
+}
+
+func (self *sdfSubtraction) Bounds() *AABB {
+	return self.left.Bounds()
+}
+
+// Twist around the Y axis, by rate degrees per unit of height
+type sdfTwist struct {
+	child SignedDistance
+	rate  float64
+	scale float64
+}
+
+func newSdfTwist(child SignedDistance, rate float64) *sdfTwist {
+	rate = rate * math.Pi / 180.0
+	// Twisting stretches distances, they are scaled down to keep a
+	// conservative step
+	scale := 0.5
+	if bounds := child.Bounds(); bounds != nil {
+		r := math.Max(math.Hypot(bounds.Min.X, bounds.Min.Z), math.Hypot(bounds.Max.X, bounds.Max.Z))
+		r = math.Max(r, math.Max(math.Hypot(bounds.Min.X, bounds.Max.Z), math.Hypot(bounds.Max.X, bounds.Min.Z)))
+		scale = 1.0 / math.Sqrt(1.0+rate*rate*r*r)
+	}
+	return &sdfTwist{child, rate, scale}
+}
+
+func (self *sdfTwist) Distance(p Vector3) float64 {
+	sin, cos := math.Sincos(self.rate * p.Y)
+	return self.child.Distance(Vector3{cos*p.X - sin*p.Z, p.Y, sin*p.X + cos*p.Z}) * self.scale
+}
+
+func (self *sdfTwist) Bounds() *AABB {
+	bounds := self.child.Bounds()
+	if bounds == nil {
+		return nil
+	}
+	r := math.Max(math.Hypot(bounds.Min.X, bounds.Min.Z), math.Hypot(bounds.Max.X, bounds.Max.Z))
+	r = math.Max(r, math.Max(math.Hypot(bounds.Min.X, bounds.Max.Z), math.Hypot(bounds.Max.X, bounds.Min.Z)))
+	return &AABB{Vector3{-r, bounds.Min.Y, -r}, Vector3{r, bounds.Max.Y, r}}
+}
+
+// Repetition of the child every period along each axis with a non zero
+// period. An optional count limits the copies on each side of the origin.
+type sdfRepeat struct {
+	child  SignedDistance
+	period Vector3
+	count  *[3]int
+}
+
+func (self *sdfRepeat) repeat(x float64, period float64, axis int) float64 {
+	if period <= 0.0 {
+		return x
+	}
+	cell := math.Floor(x/period + 0.5)
+	if self.count != nil {
+		limit := float64(self.count[axis])
+		cell = math.Max(-limit, math.Min(limit, cell))
+	}
+	return x - period*cell
+}
+
+func (self *sdfRepeat) Distance(p Vector3) float64 {
+	return self.child.Distance(Vector3{
+		self.repeat(p.X, self.period.X, 0),
+		self.repeat(p.Y, self.period.Y, 1),
+		self.repeat(p.Z, self.period.Z, 2)})
+}
+
+func (self *sdfRepeat) Bounds() *AABB {
+	bounds := self.child.Bounds()
+	if bounds == nil || self.count == nil {
+		return nil
+	}
+	extent := Vector3{
+		self.period.X * float64(self.count[0]),
+		self.period.Y * float64(self.count[1]),
+		self.period.Z * float64(self.count[2])}
+	return bounds.Union(&AABB{
+		Vector3{bounds.Min.X - extent.X, bounds.Min.Y - extent.Y, bounds.Min.Z - extent.Z},
+		Vector3{bounds.Max.X + extent.X, bounds.Max.Y + extent.Y, bounds.Max.Z + extent.Z}})
+}
+
+// SdfObject =====================================================================
+
+const (
+	sdfMaxSteps = 512
+	sdfEpsilon  = 1e-4
+)
+
+// SdfObject is a signed distance field placed at its position and
+// intersected by sphere tracing
+type SdfObject struct {
+	ObjectBase
+	Shape    SignedDistance
+	Material Material
+	bounds   *AABB
+}
+
+func NewSdfObject(position AnimatedVector, shape SignedDistance, material Material) *SdfObject {
+	bounds := shape.Bounds()
+	if bounds != nil {
+		bounds = growAABB(bounds, 2.0*sdfEpsilon)
+	}
+	return &SdfObject{ObjectBase{Position: position}, shape, material, bounds}
+}
+
+func (self *SdfObject) HitBy(ray *Ray, tmin float64, tmax float64, record *HitRecord) bool {
+	center := self.Position.At(ray.Time)
+	origin := Vector3{ray.Origin.X - center.X, ray.Origin.Y - center.Y, ray.Origin.Z - center.Z}
+	if self.bounds != nil {
+		invDir := Vector3{1.0 / ray.Direction.X, 1.0 / ray.Direction.Y, 1.0 / ray.Direction.Z}
+		var ok bool
+		if tmin, tmax, ok = self.bounds.clipSlabs(&origin, &invDir, tmin, tmax); !ok {
+			return false
+		}
+	}
+	length := ray.Direction.Length()
+	d := ray.Direction
+	at := func(t float64) Vector3 {
+		return Vector3{origin.X + t*d.X, origin.Y + t*d.Y, origin.Z + t*d.Z}
+	}
+
+	// Rays starting inside the shape look for the surface from inside. Rays
+	// starting on the surface must leave it before a hit is accepted.
+	t := tmin
+	distance := self.Shape.Distance(at(t))
+	sign := 1.0
+	if distance < 0.0 {
+		sign = -1.0
+	}
+	left := math.Abs(distance) >= 2.0*sdfEpsilon
+	for i := 0; i < sdfMaxSteps && t < tmax; i++ {
+		distance = sign * self.Shape.Distance(at(t))
+		if !left {
+			if distance < 0.0 {
+				// Crossed the surface the ray started on
+				sign = -sign
+				distance = -distance
+			}
+			left = distance >= 2.0*sdfEpsilon
+		} else if distance < sdfEpsilon {
+			record.t = t
+			record.point = ray.PointAt(t)
+			record.normal = self.normal(at(t))
+			record.u, record.v = sphereUV(record.normal)
+			record.object = self
+			return true
+		}
+		t += math.Max(distance, sdfEpsilon) / length
+	}
+	return false
+}
+
+// Gradient of the field by central differences on a tetrahedron
+func (self *SdfObject) normal(p Vector3) *Vector3 {
+	const h = sdfEpsilon
+	a := self.Shape.Distance(Vector3{p.X + h, p.Y - h, p.Z - h})
+	b := self.Shape.Distance(Vector3{p.X - h, p.Y - h, p.Z + h})
+	c := self.Shape.Distance(Vector3{p.X - h, p.Y + h, p.Z - h})
+	d := self.Shape.Distance(Vector3{p.X + h, p.Y + h, p.Z + h})
+	n := NewVector(a-b-c+d, -a-b+c+d, -a+b-c+d)
+	if n.SquaredLength() == 0.0 {
+		return NewVector(0.0, 1.0, 0.0)
+	}
+	return n.Unit()
+}
+
+func (self *SdfObject) GetMaterial() Material {
+	return self.Material
+}
+
+func (self *SdfObject) Update(t0 float64, t1 float64) {
+	self.Position.Update(t0, t1)
+}
+
+func (self *SdfObject) BoundingBox() *AABB {
+	if self.bounds == nil {
+		return nil
+	}
+	positions := self.Position.Bounds()
+	return &AABB{*self.bounds.Min.Add(&positions.Min), *self.bounds.Max.Add(&positions.Max)}
+}
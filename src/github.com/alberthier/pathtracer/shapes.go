@@ -0,0 +1,219 @@
+package pathtracer
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Infinite plane =====================================================================
+
+type Plane struct {
+	ObjectBase
+	Normal   *Vector3
+	Material Material
+	u        *Vector3
+	v        *Vector3
+}
+
+func NewPlane(position AnimatedVector, normal *Vector3, material Material) *Plane {
+	n := normal.Unit()
+	u, v := n.OrthonormalBasis()
+	return &Plane{ObjectBase{Position: position}, n, material, u, v}
+}
+
+func (self *Plane) HitBy(ray *Ray, tmin float64, tmax float64, record *HitRecord) bool {
+	denom := self.Normal.Dot(ray.Direction)
+	if math.Abs(denom) < 1e-12 {
+		return false
+	}
+	t := self.Position.At(ray.Time).Subtract(ray.Origin).Dot(self.Normal) / denom
+	if t <= tmin || tmax <= t {
+		return false
+	}
+	record.t = t
+	record.point = ray.PointAt(t)
+	record.normal = self.Normal
+	// Planar mapping, one texture unit per world unit
+	local := record.point.Subtract(self.Position.At(ray.Time))
+	record.u = local.Dot(self.u)
+	record.v = local.Dot(self.v)
+	record.object = self
+	return true
+}
+
+func (self *Plane) GetMaterial() Material {
+	return self.Material
+}
+
+func (self *Plane) Update(t0 float64, t1 float64) {
+	self.Position.Update(t0, t1)
+}
+
+func (self *Plane) BoundingBox() *AABB {
+	return nil
+}
+
+// Quad =====================================================================
+
+// Quad is the parallelogram spanned by two edges from a corner
+type Quad struct {
+	ObjectBase
+	Corner   *Vector3
+	Edge1    *Vector3
+	Edge2    *Vector3
+	Material Material
+	normal   *Vector3
+	w        *Vector3
+	d        float64
+	area     float64
+}
+
+// Returns nil when the edges are parallel or null, the quad having no area
+func NewQuad(corner *Vector3, edge1 *Vector3, edge2 *Vector3, material Material) *Quad {
+	if areParallel(edge1, edge2) {
+		return nil
+	}
+	n := edge1.Cross(edge2)
+	self := &Quad{Corner: corner, Edge1: edge1, Edge2: edge2, Material: material}
+	self.normal = n.Unit()
+	self.w = n.Scale(1.0 / n.Dot(n))
+	self.d = self.normal.Dot(corner)
+	self.area = n.Length()
+	return self
+}
+
+// NewAxisAlignedQuad builds the rectangle between two corners sharing exactly
+// one coordinate, i.e. lying in a xy, xz or yz plane. Returns nil otherwise.
+func NewAxisAlignedQuad(min *Vector3, max *Vector3, material Material) *Quad {
+	d := max.Subtract(min)
+	if d.X == 0.0 {
+		return NewQuad(min, NewVector(0.0, d.Y, 0.0), NewVector(0.0, 0.0, d.Z), material)
+	} else if d.Y == 0.0 {
+		return NewQuad(min, NewVector(0.0, 0.0, d.Z), NewVector(d.X, 0.0, 0.0), material)
+	} else if d.Z == 0.0 {
+		return NewQuad(min, NewVector(d.X, 0.0, 0.0), NewVector(0.0, d.Y, 0.0), material)
+	}
+	return nil
+}
+
+func (self *Quad) HitBy(ray *Ray, tmin float64, tmax float64, record *HitRecord) bool {
+	denom := self.normal.Dot(ray.Direction)
+	if math.Abs(denom) < 1e-12 {
+		return false
+	}
+	t := (self.d - self.normal.Dot(ray.Origin)) / denom
+	if t <= tmin || tmax <= t {
+		return false
+	}
+	point := ray.PointAt(t)
+	local := point.Subtract(self.Corner)
+	alpha := self.w.Dot(local.Cross(self.Edge2))
+	beta := self.w.Dot(self.Edge1.Cross(local))
+	if alpha < 0.0 || alpha > 1.0 || beta < 0.0 || beta > 1.0 {
+		return false
+	}
+	record.t = t
+	record.point = point
+	record.normal = self.normal
+	record.u = alpha
+	record.v = beta
+	record.object = self
+	return true
+}
+
+func (self *Quad) GetMaterial() Material {
+	return self.Material
+}
+
+func (self *Quad) Update(t0 float64, t1 float64) {
+}
+
+func (self *Quad) BoundingBox() *AABB {
+	box := NewAABB(self.Corner, self.Corner)
+	opposite := self.Corner.Add(self.Edge1).Add(self.Edge2)
+	return box.Extend(self.Corner.Add(self.Edge1)).Extend(self.Corner.Add(self.Edge2)).Extend(opposite).Pad(1e-6)
+}
+
+// Area sampling, converted to solid angle
+func (self *Quad) SampleDirection(rng *rand.Rand, origin *Vector3, time float64) (direction *Vector3, pdf float64) {
+	point := self.Corner.Add(self.Edge1.Scale(rng.Float64())).Add(self.Edge2.Scale(rng.Float64()))
+	toPoint := point.Subtract(origin)
+	distance2 := toPoint.SquaredLength()
+	direction = toPoint.Scale(1.0 / math.Sqrt(distance2))
+	cosine := math.Abs(direction.Dot(self.normal))
+	if cosine < 1e-8 {
+		return nil, 0.0
+	}
+	return direction, distance2 / (cosine * self.area)
+}
+
+func (self *Quad) DirectionPdf(origin *Vector3, direction *Vector3, time float64) float64 {
+	record := HitRecord{}
+	if !self.HitBy(NewRay(origin, direction, time), 0.0, math.MaxFloat64, &record) {
+		return 0.0
+	}
+	cosine := math.Abs(direction.Dot(self.normal))
+	if cosine < 1e-8 {
+		return 0.0
+	}
+	return record.t * record.t / (cosine * self.area)
+}
+
+// Box =====================================================================
+
+// Box is an axis aligned box made of six quads with outward normals
+type Box struct {
+	ObjectBase
+	Min      *Vector3
+	Max      *Vector3
+	Material Material
+	sides    []SceneObject
+}
+
+// Returns nil when the corners share a coordinate, the box being flat
+func NewBox(corner1 *Vector3, corner2 *Vector3, material Material) *Box {
+	min := NewVector(math.Min(corner1.X, corner2.X), math.Min(corner1.Y, corner2.Y), math.Min(corner1.Z, corner2.Z))
+	max := NewVector(math.Max(corner1.X, corner2.X), math.Max(corner1.Y, corner2.Y), math.Max(corner1.Z, corner2.Z))
+	d := max.Subtract(min)
+	if d.X == 0.0 || d.Y == 0.0 || d.Z == 0.0 {
+		return nil
+	}
+	dx := NewVector(d.X, 0.0, 0.0)
+	dy := NewVector(0.0, d.Y, 0.0)
+	dz := NewVector(0.0, 0.0, d.Z)
+	sides := []SceneObject{
+		NewQuad(min, dz, dy, material),                         // -X
+		NewQuad(max, dy.Scale(-1.0), dz.Scale(-1.0), material), // +X
+		NewQuad(min, dx, dz, material),                         // -Y
+		NewQuad(max, dz.Scale(-1.0), dx.Scale(-1.0), material), // +Y
+		NewQuad(min, dy, dx, material),                         // -Z
+		NewQuad(max, dx.Scale(-1.0), dy.Scale(-1.0), material), // +Z
+	}
+	return &Box{Min: min, Max: max, Material: material, sides: sides}
+}
+
+func (self *Box) HitBy(ray *Ray, tmin float64, tmax float64, record *HitRecord) bool {
+	hitSomething := false
+	for _, side := range self.sides {
+		if side.HitBy(ray, tmin, tmax, record) {
+			hitSomething = true
+			tmax = record.t
+		}
+	}
+	return hitSomething
+}
+
+func (self *Box) GetMaterial() Material {
+	return self.Material
+}
+
+func (self *Box) Update(t0 float64, t1 float64) {
+}
+
+func (self *Box) BoundingBox() *AABB {
+	return NewAABB(self.Min, self.Max)
+}
+
+func (self *Box) Primitives() []SceneObject {
+	return self.sides
+}
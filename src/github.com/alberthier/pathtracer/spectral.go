@@ -0,0 +1,173 @@
+package pathtracer
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Spectral rendering =====================================================================
+
+// In spectral mode each path carries a hero wavelength and two companion
+// wavelengths evenly spread over the visible range, in place of the red,
+// green and blue components of its colors.
+const minWavelength = 380.0
+const maxWavelength = 730.0
+
+// Sodium D line where refractive indices are usually given
+const referenceWavelength = 587.6
+
+func sampleWavelength(rng *rand.Rand) float64 {
+	return minWavelength + rng.Float64()*(maxWavelength-minWavelength)
+}
+
+func pathWavelengths(hero float64) [3]float64 {
+	step := (maxWavelength - minWavelength) / 3.0
+	var wavelengths [3]float64
+	for i := range wavelengths {
+		wavelengths[i] = hero + float64(i)*step
+		if wavelengths[i] >= maxWavelength {
+			wavelengths[i] -= maxWavelength - minWavelength
+		}
+	}
+	return wavelengths
+}
+
+func smoothstep(x float64, edge0 float64, edge1 float64) float64 {
+	t := clamp((x-edge0)/(edge1-edge0), 0.0, 1.0)
+	return t * t * (3.0 - 2.0*t)
+}
+
+// RGB colors are upsampled with three smooth basis spectra summing to one, so
+// that white stays flat and reflectances stay below one. The round trip to RGB
+// is within a few percent.
+func rgbToSpectrum(color *Color, wavelength float64) float64 {
+	blue := 1.0 - smoothstep(wavelength, 470.0, 500.0)
+	red := smoothstep(wavelength, 575.0, 600.0)
+	return color.R*red + color.G*(1.0-red-blue) + color.B*blue
+}
+
+// spectrum converts an RGB color to its values at the path wavelengths. It is
+// the identity outside of spectral mode.
+func (self *Ray) spectrum(color *Color) *Color {
+	if self.Wavelength == 0.0 {
+		return color
+	}
+	wavelengths := pathWavelengths(self.Wavelength)
+	return NewColor(rgbToSpectrum(color, wavelengths[0]), rgbToSpectrum(color, wavelengths[1]), rgbToSpectrum(color, wavelengths[2]))
+}
+
+// Piecewise Gaussian
+func gaussian(x float64, mean float64, sigma1 float64, sigma2 float64) float64 {
+	t := x - mean
+	if t < 0.0 {
+		t /= sigma1
+	} else {
+		t /= sigma2
+	}
+	return math.Exp(-0.5 * t * t)
+}
+
+// CIE 1931 color matching functions, multi-lobe fit from Wyman, Sloan and
+// Shirley
+func cieMatching(wavelength float64) (float64, float64, float64) {
+	x := 1.056*gaussian(wavelength, 599.8, 37.9, 31.0) + 0.362*gaussian(wavelength, 442.0, 16.0, 26.7) - 0.065*gaussian(wavelength, 501.1, 20.4, 26.2)
+	y := 0.821*gaussian(wavelength, 568.8, 46.9, 40.5) + 0.286*gaussian(wavelength, 530.9, 16.3, 31.1)
+	z := 1.217*gaussian(wavelength, 437.0, 11.8, 36.0) + 0.681*gaussian(wavelength, 459.0, 26.0, 13.8)
+	return x, y, z
+}
+
+// Linear sRGB from CIE XYZ
+func xyzToRGB(x float64, y float64, z float64) *Color {
+	return NewColor(3.2404542*x-1.5371385*y-0.4985314*z,
+		-0.9692660*x+1.8760108*y+0.0415560*z,
+		0.0556434*x-0.2040259*y+1.0572252*z)
+}
+
+// Linear sRGB of a flat unit spectrum, used to balance the output so that it
+// maps to white
+var spectralWhite = integrateSpectralWhite()
+
+func integrateSpectralWhite() *Color {
+	const steps = 1000
+	x, y, z := 0.0, 0.0, 0.0
+	for i := 0; i < steps; i++ {
+		cx, cy, cz := cieMatching(minWavelength + (float64(i)+0.5)*(maxWavelength-minWavelength)/steps)
+		x += cx
+		y += cy
+		z += cz
+	}
+	return xyzToRGB(x/steps, y/steps, z/steps)
+}
+
+// spectrumToRGB converts the radiance at the path wavelengths to linear RGB
+func spectrumToRGB(radiance *Color, hero float64) *Color {
+	x, y, z := 0.0, 0.0, 0.0
+	for i, wavelength := range pathWavelengths(hero) {
+		value := [3]float64{radiance.R, radiance.G, radiance.B}[i]
+		cx, cy, cz := cieMatching(wavelength)
+		x += value * cx / 3.0
+		y += value * cy / 3.0
+		z += value * cz / 3.0
+	}
+	rgb := xyzToRGB(x, y, z)
+	return NewColor(rgb.R/spectralWhite.R, rgb.G/spectralWhite.G, rgb.B/spectralWhite.B)
+}
+
+// Dispersion =====================================================================
+
+// Dispersion gives the refractive index at a wavelength in nanometers
+type Dispersion interface {
+	RefractiveIndex(wavelength float64) float64
+}
+
+// CauchyDispersion is the two terms Cauchy equation, B in square nanometers
+type CauchyDispersion struct {
+	A float64
+	B float64
+}
+
+// NewCauchyDispersion fits the equation to the refractive index at the
+// reference wavelength and the Abbe number
+func NewCauchyDispersion(refractiveIndex float64, abbe float64) *CauchyDispersion {
+	const f = 486.1
+	const c = 656.3
+	b := (refractiveIndex - 1.0) / (abbe * (1.0/(f*f) - 1.0/(c*c)))
+	return &CauchyDispersion{refractiveIndex - b/(referenceWavelength*referenceWavelength), b}
+}
+
+func (self *CauchyDispersion) RefractiveIndex(wavelength float64) float64 {
+	return self.A + self.B/(wavelength*wavelength)
+}
+
+// SellmeierDispersion is the Sellmeier equation, C in square micrometers
+type SellmeierDispersion struct {
+	B [3]float64
+	C [3]float64
+}
+
+func NewSellmeierDispersion(b [3]float64, c [3]float64) *SellmeierDispersion {
+	return &SellmeierDispersion{b, c}
+}
+
+func (self *SellmeierDispersion) RefractiveIndex(wavelength float64) float64 {
+	l2 := wavelength * wavelength * 1e-6
+	n2 := 1.0
+	for i := range self.B {
+		n2 += self.B[i] * l2 / (l2 - self.C[i])
+	}
+	return math.Sqrt(n2)
+}
+
+// NewDispersionPreset returns the dispersion of the common dielectrics: BK7
+// glass, diamond and water
+func NewDispersionPreset(name string) (Dispersion, bool) {
+	switch name {
+	case "glass":
+		return NewSellmeierDispersion([3]float64{1.03961212, 0.231792344, 1.01046945}, [3]float64{0.00600069867, 0.0200179144, 103.560653}), true
+	case "diamond":
+		return NewSellmeierDispersion([3]float64{4.3356, 0.3306, 0.0}, [3]float64{0.1060 * 0.1060, 0.1750 * 0.1750, 0.0}), true
+	case "water":
+		return NewCauchyDispersion(1.333, 55.7), true
+	}
+	return nil, false
+}
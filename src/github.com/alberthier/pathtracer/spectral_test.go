@@ -0,0 +1,90 @@
+package pathtracer
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPathWavelengths(t *testing.T) {
+	for _, hero := range []float64{minWavelength, 500.0, 700.0, maxWavelength - 1e-9} {
+		wavelengths := pathWavelengths(hero)
+		if wavelengths[0] != hero {
+			t.Errorf("hero %v: got %v", hero, wavelengths)
+		}
+		for _, wavelength := range wavelengths {
+			if wavelength < minWavelength || wavelength >= maxWavelength {
+				t.Errorf("hero %v: %v out of the visible range", hero, wavelengths)
+			}
+		}
+	}
+}
+
+func TestRGBToSpectrum(t *testing.T) {
+	for wavelength := minWavelength; wavelength < maxWavelength; wavelength += 5.0 {
+		if value := rgbToSpectrum(WhiteColor, wavelength); math.Abs(value-1.0) > 1e-12 {
+			t.Errorf("white is %v at %v nm", value, wavelength)
+		}
+		if value := rgbToSpectrum(NewColor(1.0, 0.0, 0.0), wavelength); value < 0.0 || value > 1.0 {
+			t.Errorf("red is %v at %v nm", value, wavelength)
+		}
+	}
+}
+
+// Colors upsampled to spectra and integrated back over the hero wavelengths
+func TestSpectralRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		color *Color
+	}{
+		{"white", NewColor(1.0, 1.0, 1.0)},
+		{"grey", NewColor(0.18, 0.18, 0.18)},
+		{"red", NewColor(0.7, 0.1, 0.1)},
+		{"green", NewColor(0.1, 0.6, 0.2)},
+		{"blue", NewColor(0.1, 0.2, 0.8)},
+	}
+	const steps = 1000
+	step := (maxWavelength - minWavelength) / 3.0 / steps
+	for _, test := range tests {
+		rgb := NewColor(0.0, 0.0, 0.0)
+		for i := 0; i < steps; i++ {
+			ray := &Ray{Wavelength: minWavelength + (float64(i)+0.5)*step}
+			rgb.AddFrom(spectrumToRGB(ray.spectrum(test.color), ray.Wavelength))
+		}
+		rgb.DivideAll(steps)
+		for _, pair := range [][2]float64{{rgb.R, test.color.R}, {rgb.G, test.color.G}, {rgb.B, test.color.B}} {
+			if math.Abs(pair[0]-pair[1]) > 0.05 {
+				t.Errorf("%s: got %v, want %v", test.name, *rgb, *test.color)
+				break
+			}
+		}
+	}
+}
+
+func TestDispersion(t *testing.T) {
+	glass, _ := NewDispersionPreset("glass")
+	diamond, _ := NewDispersionPreset("diamond")
+	tests := []struct {
+		name       string
+		dispersion Dispersion
+		wavelength float64
+		want       float64
+	}{
+		{"cauchy reference", NewCauchyDispersion(1.5, 40.0), referenceWavelength, 1.5},
+		{"BK7 d line", glass, 587.6, 1.5168},
+		{"BK7 F line", glass, 486.1, 1.5224},
+		{"BK7 C line", glass, 656.3, 1.5143},
+		{"diamond d line", diamond, 587.6, 2.417},
+	}
+	for _, test := range tests {
+		if got := test.dispersion.RefractiveIndex(test.wavelength); math.Abs(got-test.want) > 1e-3 {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// The Cauchy fit keeps the Abbe number
+	cauchy := NewCauchyDispersion(1.6, 35.0)
+	abbe := (cauchy.RefractiveIndex(587.6) - 1.0) / (cauchy.RefractiveIndex(486.1) - cauchy.RefractiveIndex(656.3))
+	if math.Abs(abbe-35.0) > 1e-6 {
+		t.Errorf("got Abbe number %v, want 35", abbe)
+	}
+}
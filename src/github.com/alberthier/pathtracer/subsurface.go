@@ -0,0 +1,144 @@
+package pathtracer
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Subsurface =====================================================================
+
+const maxSubsurfaceSteps = 256
+
+// SubsurfaceMaterial is a translucent material such as skin, wax or marble.
+// Light refracts through a rough dielectric boundary and random walks inside
+// the closed object it was hit on. The walk stops on the ray reaching the
+// boundary, which is then crossed like when entering so that light is sampled
+// on both sides. Objects which are not closed are only crossed.
+type SubsurfaceMaterial struct {
+	MaterialBase
+	albedo          Texture
+	meanFreePath    *Color
+	refractiveIndex float64
+	distribution    ggx
+}
+
+func NewSubsurfaceMaterial(albedo Texture, meanFreePath *Color, refractiveIndex float64, roughness float64) *SubsurfaceMaterial {
+	return &SubsurfaceMaterial{albedo: albedo, meanFreePath: meanFreePath, refractiveIndex: refractiveIndex, distribution: newGGX(roughness)}
+}
+
+// Single scattering albedo giving approximately the multiple scattering
+// albedo seen on the surface, inverting van de Hulst's relation
+func singleScatteringAlbedo(albedo float64) float64 {
+	albedo = math.Max(0.0, math.Min(albedo, 0.999))
+	s := 4.09712 + 4.20863*albedo - math.Sqrt(9.59217+41.6808*albedo+17.7126*albedo*albedo)
+	return 1.0 - s*s
+}
+
+func randomDirection(rng *rand.Rand) *Vector3 {
+	z := 1.0 - 2.0*rng.Float64()
+	r := math.Sqrt(math.Max(0.0, 1.0-z*z))
+	phi := 2.0 * math.Pi * rng.Float64()
+	return NewVector(r*math.Cos(phi), r*math.Sin(phi), z)
+}
+
+// Frame on the side of direction, and the refractive index ratio of the other
+// side over this one
+func (self *SubsurfaceMaterial) frame(direction *Vector3, record *HitRecord) (localFrame, float64) {
+	if direction.Dot(record.normal) > 0.0 {
+		return newLocalFrame(record.normal.Scale(-1.0)), 1.0 / self.refractiveIndex
+	}
+	return newLocalFrame(record.normal), self.refractiveIndex
+}
+
+// The free flight distance is sampled with a randomly chosen channel, and
+// weighted by the pdf of the three channels combined
+func (self *SubsurfaceMaterial) Scatter(rng *rand.Rand, ray *Ray, record *HitRecord) (attenuation *Color, scattered *Ray) {
+	frame, eta := self.frame(ray.Direction, record)
+	wo := frame.toLocal(ray.Direction.Unit().Scale(-1.0))
+	if wo.Z <= 0.0 {
+		return nil, nil
+	}
+	wi := sampleRoughDielectric(rng, self.distribution, wo, eta)
+	if wi == nil {
+		return nil, nil
+	}
+	weight := self.distribution.G2(wo, wi) / self.distribution.G1(wo)
+	throughput := NewColor(weight, weight, weight)
+	direction := frame.toWorld(wi).Unit()
+	if direction.Dot(record.normal) > 0.0 || record.root == nil {
+		// Reflected on the surface, or refracted out of the object
+		return throughput, NewRay(record.point, direction, ray.Time)
+	}
+
+	albedo := self.albedo.Color(record.u, record.v, record.point)
+	extinction := [3]float64{1.0 / self.meanFreePath.R, 1.0 / self.meanFreePath.G, 1.0 / self.meanFreePath.B}
+	scattering := [3]float64{singleScatteringAlbedo(albedo.R) * extinction[0],
+		singleScatteringAlbedo(albedo.G) * extinction[1],
+		singleScatteringAlbedo(albedo.B) * extinction[2]}
+	point := record.point
+	for step := 0; step < maxSubsurfaceSteps; step++ {
+		boundary := HitRecord{}
+		if !hitObject(record.root, NewRay(point, direction, ray.Time), 0.001, math.MaxFloat64, &boundary) {
+			// The object is not closed, light leaves through the opening, or
+			// goes through thin surfaces like through a rough dielectric
+			return throughput, NewRay(point, direction, ray.Time)
+		}
+		// Channels are chosen in proportion to the throughput
+		channels := [3]float64{throughput.R, throughput.G, throughput.B}
+		total := channels[0] + channels[1] + channels[2]
+		if total <= 0.0 {
+			return nil, nil
+		}
+		channel := 0
+		for u := rng.Float64() * total; channel < 2 && u >= channels[channel]; channel++ {
+			u -= channels[channel]
+		}
+		distance := -math.Log(1.0-rng.Float64()) / extinction[channel]
+		scatters := distance < boundary.t
+		if !scatters {
+			distance = boundary.t
+		}
+		var transmittance [3]float64
+		pdf := 0.0
+		for c := 0; c < 3; c++ {
+			transmittance[c] = math.Exp(-extinction[c] * distance)
+			if scatters {
+				pdf += channels[c] / total * extinction[c] * transmittance[c]
+			} else {
+				pdf += channels[c] / total * transmittance[c]
+			}
+		}
+		if !scatters {
+			throughput = NewColor(throughput.R*transmittance[0]/pdf,
+				throughput.G*transmittance[1]/pdf,
+				throughput.B*transmittance[2]/pdf)
+			return throughput, NewRay(point, direction, ray.Time)
+		}
+		throughput = NewColor(throughput.R*scattering[0]*transmittance[0]/pdf,
+			throughput.G*scattering[1]*transmittance[1]/pdf,
+			throughput.B*scattering[2]*transmittance[2]/pdf)
+		point = point.Add(direction.Scale(distance))
+		direction = randomDirection(rng)
+	}
+	return nil, nil
+}
+
+// Only directions leaving the object are evaluated, light is never sampled
+// from inside
+func (self *SubsurfaceMaterial) evalPdf(ray *Ray, record *HitRecord, direction *Vector3) (float64, float64) {
+	if direction.Dot(record.normal) <= 0.0 {
+		return 0.0, 0.0
+	}
+	frame, eta := self.frame(ray.Direction, record)
+	return evalRoughDielectric(self.distribution, frame.toLocal(ray.Direction.Unit().Scale(-1.0)), frame.toLocal(direction), eta)
+}
+
+func (self *SubsurfaceMaterial) Eval(ray *Ray, record *HitRecord, direction *Vector3) *Color {
+	f, _ := self.evalPdf(ray, record, direction)
+	return NewColor(f, f, f)
+}
+
+func (self *SubsurfaceMaterial) Pdf(ray *Ray, record *HitRecord, direction *Vector3) float64 {
+	_, pdf := self.evalPdf(ray, record, direction)
+	return pdf
+}
@@ -1,24 +1,63 @@
 package pathtracer
 
 import (
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
 	"math"
+	"os"
+	"sort"
 )
 
+// Textures are evaluated from the (u, v) surface coordinates of the hit
+// point or, for procedural ones, from its position in space
 type Texture interface {
-	Color(point *Vector3) *Color
+	Color(u float64, v float64, point *Vector3) *Color
 }
 
-func NewTexture(typ string, color [3]float64, size float64, param1 string, param2 string, textures *map[string]Texture) Texture {
-	switch typ {
+func NewTexture(data *FileTexture, textures *map[string]Texture) Texture {
+	switch data.Type {
 	case "static":
-		return NewStaticTexture(NewColor(color[0], color[1], color[2]))
+		return NewStaticTexture(NewColor(data.Color[0], data.Color[1], data.Color[2]))
 	case "checker":
-		texture1, ok1 := (*textures)[param1]
-		texture2, ok2 := (*textures)[param2]
+		texture1, ok1 := (*textures)[data.Texture1]
+		texture2, ok2 := (*textures)[data.Texture2]
 		if ok1 && ok2 {
-			return NewCheckerTexture(size, texture1, texture2)
+			return NewCheckerTexture(data.Size, texture1, texture2)
 		}
 		break
+	case "noise", "turbulence", "marble":
+		scale := data.Scale
+		if scale == 0.0 {
+			scale = 1.0
+		}
+		octaves := data.Octaves
+		if octaves <= 0 && data.Type == "noise" {
+			octaves = 1
+		} else if octaves <= 0 {
+			octaves = 7
+		}
+		stops := []ColorStop{}
+		for _, stop := range data.Ramp {
+			stops = append(stops, ColorStop{stop.Position, NewColor(stop.Color[0], stop.Color[1], stop.Color[2])})
+		}
+		if len(stops) == 0 {
+			stops = []ColorStop{{0.0, BlackColor}, {1.0, WhiteColor}}
+		}
+		ramp := NewColorRamp(stops)
+		perlin := NewPerlin(data.Seed)
+		switch data.Type {
+		case "noise":
+			return NewNoiseTexture(perlin, scale, octaves, ramp)
+		case "turbulence":
+			return NewTurbulenceTexture(perlin, scale, octaves, ramp)
+		}
+		distortion := data.Distortion
+		if distortion == 0.0 {
+			distortion = 10.0
+		}
+		return NewMarbleTexture(perlin, scale, octaves, distortion, ramp)
 	}
 	return nil
 }
@@ -33,7 +72,7 @@ func NewStaticTexture(color *Color) *StaticColor {
 	return &StaticColor{color}
 }
 
-func (self *StaticColor) Color(point *Vector3) *Color {
+func (self *StaticColor) Color(u float64, v float64, point *Vector3) *Color {
 	return self.color
 }
 
@@ -49,11 +88,211 @@ func NewCheckerTexture(size float64, evenTexture Texture, oddTexture Texture) *C
 	return &CheckerTexture{size, evenTexture, oddTexture}
 }
 
-func (self *CheckerTexture) Color(point *Vector3) *Color {
+func (self *CheckerTexture) Color(u float64, v float64, point *Vector3) *Color {
 	s := math.Sin(self.size*point.X) * math.Sin(self.size*point.Y) * math.Sin(self.size*point.Z)
 	if s < 0 {
-		return self.oddTexture.Color(point)
+		return self.oddTexture.Color(u, v, point)
 	} else {
-		return self.evenTexture.Color(point)
+		return self.evenTexture.Color(u, v, point)
+	}
+}
+
+// Image texture =======================================================
+
+type WrapMode int
+
+const (
+	WrapRepeat WrapMode = iota
+	WrapClamp
+	WrapMirror
+)
+
+// The wrap mode defaults to repeat
+func NewWrapMode(name string) (WrapMode, bool) {
+	switch name {
+	case "", "repeat":
+		return WrapRepeat, true
+	case "clamp":
+		return WrapClamp, true
+	case "mirror":
+		return WrapMirror, true
+	}
+	return WrapRepeat, false
+}
+
+// Image colors are stored in sRGB, convert them to linear values
+func srgbToLinear(value float64) float64 {
+	if value <= 0.04045 {
+		return value / 12.92
+	}
+	return math.Pow((value+0.055)/1.055, 2.4)
+}
+
+type ImageTexture struct {
+	image *FloatImage
+	wrap  WrapMode
+}
+
+func NewImageTexture(img *FloatImage, wrap WrapMode) *ImageTexture {
+	return &ImageTexture{img, wrap}
+}
+
+// LoadImageTexture reads a PNG or JPEG image
+func LoadImageTexture(filename string, wrap WrapMode) (*ImageTexture, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	src, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	bounds := src.Bounds()
+	img := NewFloatImage(bounds.Dx(), bounds.Dy())
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			r, g, b, _ := src.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			img.Set(x, y, NewColor(srgbToLinear(float64(r)/0xffff),
+				srgbToLinear(float64(g)/0xffff),
+				srgbToLinear(float64(b)/0xffff)))
+		}
 	}
+	return NewImageTexture(img, wrap), nil
+}
+
+func wrapCoordinate(i int, size int, wrap WrapMode) int {
+	switch wrap {
+	case WrapClamp:
+		if i < 0 {
+			return 0
+		}
+		if i >= size {
+			return size - 1
+		}
+		return i
+	case WrapMirror:
+		period := 2 * size
+		i = ((i % period) + period) % period
+		if i >= size {
+			return period - i - 1
+		}
+		return i
+	}
+	return ((i % size) + size) % size
+}
+
+// sampleBilinear filters the image at continuous pixel coordinates, pixel
+// centers being at integer coordinates. Coordinates out of the image are
+// wrapped on each axis.
+func sampleBilinear(img *FloatImage, x float64, y float64, wrapX WrapMode, wrapY WrapMode) *Color {
+	fx := math.Floor(x)
+	fy := math.Floor(y)
+	tx := x - fx
+	ty := y - fy
+	x0 := wrapCoordinate(int(fx), img.Width, wrapX)
+	x1 := wrapCoordinate(int(fx)+1, img.Width, wrapX)
+	y0 := wrapCoordinate(int(fy), img.Height, wrapY)
+	y1 := wrapCoordinate(int(fy)+1, img.Height, wrapY)
+	c00 := img.At(x0, y0)
+	c10 := img.At(x1, y0)
+	c01 := img.At(x0, y1)
+	c11 := img.At(x1, y1)
+	w00 := (1 - tx) * (1 - ty)
+	w10 := tx * (1 - ty)
+	w01 := (1 - tx) * ty
+	w11 := tx * ty
+	return NewColor(c00.R*w00+c10.R*w10+c01.R*w01+c11.R*w11,
+		c00.G*w00+c10.G*w10+c01.G*w01+c11.G*w11,
+		c00.B*w00+c10.B*w10+c01.B*w01+c11.B*w11)
+}
+
+func (self *ImageTexture) Color(u float64, v float64, point *Vector3) *Color {
+	// v goes from the bottom to the top of the image
+	return sampleBilinear(self.image, u*float64(self.image.Width)-0.5, (1.0-v)*float64(self.image.Height)-0.5, self.wrap, self.wrap)
+}
+
+// Color ramp =======================================================
+
+type ColorStop struct {
+	Position float64
+	Color    *Color
+}
+
+// ColorRamp maps values to colors by interpolating between sorted stops
+type ColorRamp struct {
+	stops []ColorStop
+}
+
+func NewColorRamp(stops []ColorStop) *ColorRamp {
+	sorted := append([]ColorStop{}, stops...)
+	sort.SliceStable(sorted, func(i int, j int) bool { return sorted[i].Position < sorted[j].Position })
+	return &ColorRamp{sorted}
+}
+
+func (self *ColorRamp) At(t float64) *Color {
+	if t <= self.stops[0].Position {
+		return self.stops[0].Color
+	}
+	for i := 1; i < len(self.stops); i++ {
+		next := &self.stops[i]
+		if t < next.Position {
+			prev := &self.stops[i-1]
+			f := (t - prev.Position) / (next.Position - prev.Position)
+			return NewColor(lerp(f, prev.Color.R, next.Color.R),
+				lerp(f, prev.Color.G, next.Color.G),
+				lerp(f, prev.Color.B, next.Color.B))
+		}
+	}
+	return self.stops[len(self.stops)-1].Color
+}
+
+// Noise textures =======================================================
+
+type NoiseTexture struct {
+	perlin  *Perlin
+	scale   float64
+	octaves int
+	ramp    *ColorRamp
+}
+
+func NewNoiseTexture(perlin *Perlin, scale float64, octaves int, ramp *ColorRamp) *NoiseTexture {
+	return &NoiseTexture{perlin, scale, octaves, ramp}
+}
+
+func (self *NoiseTexture) Color(u float64, v float64, point *Vector3) *Color {
+	return self.ramp.At(0.5 * (1.0 + self.perlin.FBM(point.Scale(self.scale), self.octaves)))
+}
+
+type TurbulenceTexture struct {
+	perlin  *Perlin
+	scale   float64
+	octaves int
+	ramp    *ColorRamp
+}
+
+func NewTurbulenceTexture(perlin *Perlin, scale float64, octaves int, ramp *ColorRamp) *TurbulenceTexture {
+	return &TurbulenceTexture{perlin, scale, octaves, ramp}
+}
+
+func (self *TurbulenceTexture) Color(u float64, v float64, point *Vector3) *Color {
+	return self.ramp.At(self.perlin.Turbulence(point.Scale(self.scale), self.octaves))
+}
+
+// Marble veins are a sine wave along X phase shifted by turbulence
+type MarbleTexture struct {
+	perlin     *Perlin
+	scale      float64
+	octaves    int
+	distortion float64
+	ramp       *ColorRamp
+}
+
+func NewMarbleTexture(perlin *Perlin, scale float64, octaves int, distortion float64, ramp *ColorRamp) *MarbleTexture {
+	return &MarbleTexture{perlin, scale, octaves, distortion, ramp}
+}
+
+func (self *MarbleTexture) Color(u float64, v float64, point *Vector3) *Color {
+	p := point.Scale(self.scale)
+	return self.ramp.At(0.5 * (1.0 + math.Sin(p.X+self.distortion*self.perlin.Turbulence(p, self.octaves))))
 }
@@ -0,0 +1,102 @@
+package pathtracer
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+)
+
+// Thin film =====================================================================
+
+// Wavelengths at which the film reflectance is integrated into RGB
+const thinFilmSamples = 32
+
+// ThinFilm is a coating whose reflections interfere, giving the angle
+// dependent colors of soap bubbles and oil slicks. The thickness is in
+// nanometers, scaled by the average of the optional texture.
+type ThinFilm struct {
+	thickness        float64
+	refractiveIndex  float64
+	thicknessTexture Texture
+}
+
+func NewThinFilm(thickness float64, refractiveIndex float64, thicknessTexture Texture) *ThinFilm {
+	return &ThinFilm{thickness, refractiveIndex, thicknessTexture}
+}
+
+func (self *ThinFilm) thicknessAt(record *HitRecord) float64 {
+	if self.thicknessTexture == nil {
+		return self.thickness
+	}
+	color := self.thicknessTexture.Color(record.u, record.v, record.point)
+	return self.thickness * (color.R + color.G + color.B) / 3.0
+}
+
+// Fresnel amplitude coefficients from medium 1 to medium 2, and the cosine in
+// medium 2
+func fresnelAmplitudes(n1 complex128, n2 complex128, cos1 complex128) (complex128, complex128, complex128) {
+	ratio := n1 / n2
+	cos2 := cmplx.Sqrt(1.0 - ratio*ratio*(1.0-cos1*cos1))
+	rs := (n1*cos1 - n2*cos2) / (n1*cos1 + n2*cos2)
+	rp := (n2*cos1 - n1*cos2) / (n2*cos1 + n1*cos2)
+	return rs, rp, cos2
+}
+
+// Airy reflectance of the film between the incident medium and the substrate,
+// averaged over both polarizations
+func (self *ThinFilm) reflectance(thickness float64, wavelength float64, cosine float64, incident float64, substrate complex128) float64 {
+	n1 := complex(incident, 0.0)
+	n2 := complex(self.refractiveIndex, 0.0)
+	rs12, rp12, cos2 := fresnelAmplitudes(n1, n2, complex(cosine, 0.0))
+	rs23, rp23, _ := fresnelAmplitudes(n2, substrate, cos2)
+	phase := cmplx.Exp(complex(0.0, 4.0*math.Pi/wavelength*thickness) * n2 * cos2)
+	rs := (rs12 + rs23*phase) / (1.0 + rs12*rs23*phase)
+	rp := (rp12 + rp23*phase) / (1.0 + rp12*rp23*phase)
+	return 0.5 * (real(rs*cmplx.Conj(rs)) + real(rp*cmplx.Conj(rp)))
+}
+
+// Reflectance returns the RGB reflectance of the film under the incident
+// cosine. The substrate refractive index is given per wavelength.
+func (self *ThinFilm) Reflectance(record *HitRecord, cosine float64, incident float64, substrate func(wavelength float64) complex128) *Color {
+	thickness := self.thicknessAt(record)
+	x, y, z := 0.0, 0.0, 0.0
+	for i := 0; i < thinFilmSamples; i++ {
+		wavelength := minWavelength + (float64(i)+0.5)*(maxWavelength-minWavelength)/thinFilmSamples
+		r := self.reflectance(thickness, wavelength, cosine, incident, substrate(wavelength))
+		cx, cy, cz := cieMatching(wavelength)
+		x += r * cx / thinFilmSamples
+		y += r * cy / thinFilmSamples
+		z += r * cz / thinFilmSamples
+	}
+	rgb := xyzToRGB(x, y, z)
+	return NewColor(clamp(rgb.R/spectralWhite.R, 0.0, 1.0),
+		clamp(rgb.G/spectralWhite.G, 0.0, 1.0),
+		clamp(rgb.B/spectralWhite.B, 0.0, 1.0))
+}
+
+// Refractive index of a dielectric with the given normal incidence
+// reflectance, standing for a metal under the film
+func reflectanceToRefractiveIndex(reflectance float64) float64 {
+	r := math.Sqrt(clamp(reflectance, 0.0, 0.99))
+	return (1.0 + r) / (1.0 - r)
+}
+
+// Film of a metal or dielectric material, nil when it has none or when its
+// texture is unknown. The refractive index defaults to the one of soap water.
+func newThinFilm(data *FileMaterial, textures *map[string]Texture) *ThinFilm {
+	if data.Film == nil {
+		return nil
+	}
+	var texture Texture
+	if len(data.Film.Texture) != 0 {
+		if texture = (*textures)[data.Film.Texture]; texture == nil {
+			fmt.Printf("Unknown film thickness texture: '%s'\n", data.Film.Texture)
+			return nil
+		}
+	}
+	ior := data.Film.Ior
+	if ior == 0.0 {
+		ior = 1.33
+	}
+	return NewThinFilm(data.Film.Thickness, ior, texture)
+}
@@ -0,0 +1,233 @@
+package pathtracer
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Matrix4 is a row major affine transformation matrix
+type Matrix4 [4][4]float64
+
+func IdentityMatrix() *Matrix4 {
+	return &Matrix4{{1, 0, 0, 0}, {0, 1, 0, 0}, {0, 0, 1, 0}, {0, 0, 0, 1}}
+}
+
+func (self *Matrix4) Multiply(other *Matrix4) *Matrix4 {
+	result := &Matrix4{}
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			for k := 0; k < 4; k++ {
+				result[i][j] += self[i][k] * other[k][j]
+			}
+		}
+	}
+	return result
+}
+
+func (self *Matrix4) Transpose() *Matrix4 {
+	result := &Matrix4{}
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			result[i][j] = self[j][i]
+		}
+	}
+	return result
+}
+
+// Inverse by Gauss-Jordan elimination, nil for singular matrices
+func (self *Matrix4) Inverse() *Matrix4 {
+	m := *self
+	inv := *IdentityMatrix()
+	for col := 0; col < 4; col++ {
+		pivot := col
+		for row := col + 1; row < 4; row++ {
+			if math.Abs(m[row][col]) > math.Abs(m[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(m[pivot][col]) < 1e-12 {
+			return nil
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+		f := 1.0 / m[col][col]
+		for j := 0; j < 4; j++ {
+			m[col][j] *= f
+			inv[col][j] *= f
+		}
+		for row := 0; row < 4; row++ {
+			if row != col {
+				f := m[row][col]
+				for j := 0; j < 4; j++ {
+					m[row][j] -= f * m[col][j]
+					inv[row][j] -= f * inv[col][j]
+				}
+			}
+		}
+	}
+	return &inv
+}
+
+// Determinant of the linear part, by which volumes are scaled
+func (self *Matrix4) Determinant() float64 {
+	return self[0][0]*(self[1][1]*self[2][2]-self[1][2]*self[2][1]) -
+		self[0][1]*(self[1][0]*self[2][2]-self[1][2]*self[2][0]) +
+		self[0][2]*(self[1][0]*self[2][1]-self[1][1]*self[2][0])
+}
+
+func (self *Matrix4) TransformPoint(p *Vector3) *Vector3 {
+	return &Vector3{
+		self[0][0]*p.X + self[0][1]*p.Y + self[0][2]*p.Z + self[0][3],
+		self[1][0]*p.X + self[1][1]*p.Y + self[1][2]*p.Z + self[1][3],
+		self[2][0]*p.X + self[2][1]*p.Y + self[2][2]*p.Z + self[2][3]}
+}
+
+func (self *Matrix4) TransformVector(v *Vector3) *Vector3 {
+	return &Vector3{
+		self[0][0]*v.X + self[0][1]*v.Y + self[0][2]*v.Z,
+		self[1][0]*v.X + self[1][1]*v.Y + self[1][2]*v.Z,
+		self[2][0]*v.X + self[2][1]*v.Y + self[2][2]*v.Z}
+}
+
+func TranslationMatrix(offset *Vector3) *Matrix4 {
+	m := IdentityMatrix()
+	m[0][3], m[1][3], m[2][3] = offset.X, offset.Y, offset.Z
+	return m
+}
+
+func ScaleMatrix(factors *Vector3) *Matrix4 {
+	m := IdentityMatrix()
+	m[0][0], m[1][1], m[2][2] = factors.X, factors.Y, factors.Z
+	return m
+}
+
+// RotationMatrix rotates around an arbitrary axis, the angle is in degrees
+func RotationMatrix(axis *Vector3, angle float64) *Matrix4 {
+	a := axis.Unit()
+	theta := angle * math.Pi / 180.0
+	c, s := math.Cos(theta), math.Sin(theta)
+	t := 1.0 - c
+	return &Matrix4{
+		{t*a.X*a.X + c, t*a.X*a.Y - s*a.Z, t*a.X*a.Z + s*a.Y, 0},
+		{t*a.X*a.Y + s*a.Z, t*a.Y*a.Y + c, t*a.Y*a.Z - s*a.X, 0},
+		{t*a.X*a.Z - s*a.Y, t*a.Y*a.Z + s*a.X, t*a.Z*a.Z + c, 0},
+		{0, 0, 0, 1}}
+}
+
+// Transform =====================================================================
+
+// Transform maps object space to world space and keeps the inverse mapping
+type Transform struct {
+	Matrix  *Matrix4
+	Inverse *Matrix4
+	normal  *Matrix4
+}
+
+func NewTransform(matrix *Matrix4) *Transform {
+	inverse := matrix.Inverse()
+	if inverse == nil {
+		return nil
+	}
+	return &Transform{matrix, inverse, inverse.Transpose()}
+}
+
+// Then returns the transform applying self first and other afterwards
+func (self *Transform) Then(other *Transform) *Transform {
+	return NewTransform(other.Matrix.Multiply(self.Matrix))
+}
+
+// The direction isn't normalized so that hit distances are the same in both
+// spaces. The other ray properties are kept.
+func (self *Transform) RayToObject(ray *Ray) *Ray {
+	result := *ray
+	result.Origin = self.Inverse.TransformPoint(ray.Origin)
+	result.Direction = self.Inverse.TransformVector(ray.Direction)
+	return &result
+}
+
+func (self *Transform) PointToWorld(p *Vector3) *Vector3 {
+	return self.Matrix.TransformPoint(p)
+}
+
+// Normals are transformed by the inverse transpose matrix
+func (self *Transform) NormalToWorld(n *Vector3) *Vector3 {
+	return self.normal.TransformVector(n).Unit()
+}
+
+func (self *Transform) BoxToWorld(box *AABB) *AABB {
+	result := emptyAABB()
+	for i := 0; i < 8; i++ {
+		corner := Vector3{box.Min.X, box.Min.Y, box.Min.Z}
+		if i&1 != 0 {
+			corner.X = box.Max.X
+		}
+		if i&2 != 0 {
+			corner.Y = box.Max.Y
+		}
+		if i&4 != 0 {
+			corner.Z = box.Max.Z
+		}
+		result = result.Extend(self.Matrix.TransformPoint(&corner))
+	}
+	return result
+}
+
+// hitObject intersects an object, transforming the ray into its object space
+// when it has a transform and the hit back into world space
+func hitObject(obj SceneObject, ray *Ray, tmin float64, tmax float64, record *HitRecord) bool {
+	transform := obj.GetTransform()
+	if transform == nil {
+		if !obj.HitBy(ray, tmin, tmax, record) {
+			return false
+		}
+		record.root = obj
+		return true
+	}
+	if !obj.HitBy(transform.RayToObject(ray), tmin, tmax, record) {
+		return false
+	}
+	record.point = ray.PointAt(record.t)
+	record.normal = transform.NormalToWorld(record.normal)
+	record.root = obj
+	return true
+}
+
+// transformedLight samples a light in the object space of its transform. The
+// linear part A of the transform maps the object space direction u to the
+// direction of A u, scaling solid angles by |det A| / |A u|^3.
+type transformedLight struct {
+	light       SampledObject
+	transform   *Transform
+	determinant float64
+}
+
+func newTransformedLight(light SampledObject, transform *Transform) *transformedLight {
+	return &transformedLight{light, transform, math.Abs(transform.Matrix.Determinant())}
+}
+
+func (self *transformedLight) SampleDirection(rng *rand.Rand, origin *Vector3, time float64) (direction *Vector3, pdf float64) {
+	direction, pdf = self.light.SampleDirection(rng, self.transform.Inverse.TransformPoint(origin), time)
+	if direction == nil {
+		return nil, 0.0
+	}
+	direction = self.transform.Matrix.TransformVector(direction)
+	length := direction.Length()
+	return direction.Scale(1.0 / length), pdf * length * length * length / self.determinant
+}
+
+func (self *transformedLight) DirectionPdf(origin *Vector3, direction *Vector3, time float64) float64 {
+	local := self.transform.Inverse.TransformVector(direction)
+	length := local.Length()
+	pdf := self.light.DirectionPdf(self.transform.Inverse.TransformPoint(origin), local.Scale(1.0/length), time)
+	return pdf / (length * length * length * self.determinant)
+}
+
+// objectBoundingBox is the world space bounding box of an object
+func objectBoundingBox(obj SceneObject) *AABB {
+	box := obj.BoundingBox()
+	transform := obj.GetTransform()
+	if box == nil || transform == nil {
+		return box
+	}
+	return transform.BoxToWorld(box)
+}
@@ -0,0 +1,61 @@
+package pathtracer
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMatrixInverse(t *testing.T) {
+	tests := []struct {
+		name   string
+		matrix *Matrix4
+	}{
+		{"identity", IdentityMatrix()},
+		{"translation", TranslationMatrix(NewVector(1.0, -2.0, 3.5))},
+		{"scale", ScaleMatrix(NewVector(2.0, 0.5, -4.0))},
+		{"rotation", RotationMatrix(NewVector(1.0, 1.0, 0.0), 0.7)},
+		{"composed", TranslationMatrix(NewVector(-3.0, 0.0, 1.0)).Multiply(RotationMatrix(NewVector(0.0, 0.0, 1.0), 2.0)).Multiply(ScaleMatrix(NewVector(0.1, 3.0, 1.0)))},
+		// Needs row swaps, the first pivot being null
+		{"permutation", &Matrix4{{0, 1, 0, 0}, {0, 0, 1, 0}, {1, 0, 0, 0}, {0, 0, 0, 1}}},
+	}
+	for _, test := range tests {
+		inverse := test.matrix.Inverse()
+		if inverse == nil {
+			t.Errorf("%s: no inverse", test.name)
+			continue
+		}
+		for _, product := range []*Matrix4{test.matrix.Multiply(inverse), inverse.Multiply(test.matrix)} {
+			identity := IdentityMatrix()
+			for i := 0; i < 4; i++ {
+				for j := 0; j < 4; j++ {
+					if math.Abs(product[i][j]-identity[i][j]) > 1e-12 {
+						t.Errorf("%s: M*Inverse(M) = %v", test.name, *product)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestSingularMatrixInverse(t *testing.T) {
+	if ScaleMatrix(NewVector(1.0, 0.0, 1.0)).Inverse() != nil {
+		t.Error("singular matrix inverted")
+	}
+}
+
+func TestMatrixDeterminant(t *testing.T) {
+	tests := []struct {
+		name   string
+		matrix *Matrix4
+		want   float64
+	}{
+		{"translation", TranslationMatrix(NewVector(1.0, 2.0, 3.0)), 1.0},
+		{"scale", ScaleMatrix(NewVector(2.0, 0.5, -4.0)), -4.0},
+		{"rotation", RotationMatrix(NewVector(0.0, 1.0, 1.0), 1.2), 1.0},
+	}
+	for _, test := range tests {
+		if got := test.matrix.Determinant(); math.Abs(got-test.want) > 1e-12 {
+			t.Errorf("%s: got determinant %v, want %v", test.name, got, test.want)
+		}
+	}
+}
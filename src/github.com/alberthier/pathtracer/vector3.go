@@ -59,3 +59,17 @@ func (self *Vector3) SquaredLength() float64 {
 func (self *Vector3) Unit() *Vector3 {
 	return self.Scale(1.0 / self.Length())
 }
+
+// OrthonormalBasis returns two unit vectors forming with the unit vector w a
+// right handed orthonormal basis
+func (self *Vector3) OrthonormalBasis() (*Vector3, *Vector3) {
+	var a *Vector3
+	if math.Abs(self.X) > 0.9 {
+		a = NewVector(0.0, 1.0, 0.0)
+	} else {
+		a = NewVector(1.0, 0.0, 0.0)
+	}
+	v := self.Cross(a).Unit()
+	u := v.Cross(self)
+	return u, v
+}
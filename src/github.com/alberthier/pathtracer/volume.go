@@ -0,0 +1,157 @@
+package pathtracer
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Volume =====================================================================
+
+// Volume is a participating medium of constant density filling a closed
+// boundary object, or the whole space without boundary. Rays travel an
+// exponentially distributed distance before scattering with the material,
+// which is usually a phase material.
+type Volume struct {
+	ObjectBase
+	Boundary SceneObject
+	Density  float64
+	Material Material
+}
+
+func NewVolume(boundary SceneObject, density float64, material Material) *Volume {
+	return &Volume{Boundary: boundary, Density: density, Material: material}
+}
+
+func (self *Volume) spans(ray *Ray, tmin float64, tmax float64) []Span {
+	if self.Boundary == nil {
+		return []Span{{HitRecord{t: tmin}, HitRecord{t: tmax}}}
+	}
+	return objectSpans(self.Boundary, ray)
+}
+
+func (self *Volume) HitBy(ray *Ray, tmin float64, tmax float64, record *HitRecord) bool {
+	if ray.Rng == nil {
+		return false
+	}
+	length := ray.Direction.Length()
+	for _, span := range self.spans(ray, tmin, tmax) {
+		t0 := math.Max(span.Enter.t, tmin)
+		t1 := math.Min(span.Exit.t, tmax)
+		if t0 >= t1 {
+			continue
+		}
+		// Free flight distance
+		distance := -math.Log(1.0-ray.Rng.Float64()) / self.Density
+		if distance >= (t1-t0)*length {
+			continue
+		}
+		record.t = t0 + distance/length
+		record.point = ray.PointAt(record.t)
+		record.normal = ray.Direction.Scale(-1.0 / length)
+		record.u, record.v = 0.0, 0.0
+		record.object = self
+		return true
+	}
+	return false
+}
+
+func (self *Volume) Transmittance(rng *rand.Rand, ray *Ray, tmin float64, tmax float64) float64 {
+	depth := 0.0
+	for _, span := range self.spans(ray, tmin, tmax) {
+		depth += math.Max(0.0, math.Min(span.Exit.t, tmax)-math.Max(span.Enter.t, tmin))
+	}
+	return math.Exp(-self.Density * depth * ray.Direction.Length())
+}
+
+func (self *Volume) GetMaterial() Material {
+	return self.Material
+}
+
+func (self *Volume) Update(t0 float64, t1 float64) {
+	if self.Boundary != nil {
+		self.Boundary.Update(t0, t1)
+	}
+}
+
+func (self *Volume) BoundingBox() *AABB {
+	if self.Boundary == nil {
+		return nil
+	}
+	return objectBoundingBox(self.Boundary)
+}
+
+// GridVolume =====================================================================
+
+// GridVolume is a heterogeneous medium whose density is the grid value times
+// the density scale. Scattering uses delta tracking and shadow rays use ratio
+// tracking against the maximum density of the grid.
+type GridVolume struct {
+	ObjectBase
+	Grid     *DensityGrid
+	Density  float64
+	Material Material
+}
+
+func NewGridVolume(grid *DensityGrid, density float64, material Material) *GridVolume {
+	return &GridVolume{Grid: grid, Density: density, Material: material}
+}
+
+// Tentative collisions are sampled against the majorant, the ratio of the real
+// density decides whether they are real or null collisions
+func (self *GridVolume) collisions(rng *rand.Rand, ray *Ray, tmin float64, tmax float64, collide func(t float64, ratio float64) bool) {
+	invDir := Vector3{1.0 / ray.Direction.X, 1.0 / ray.Direction.Y, 1.0 / ray.Direction.Z}
+	t0, t1, ok := self.Grid.Box.clipSlabs(ray.Origin, &invDir, tmin, tmax)
+	majorant := self.Density * self.Grid.Maximum()
+	if !ok || majorant <= 0.0 {
+		return
+	}
+	step := 1.0 / (majorant * ray.Direction.Length())
+	for t := t0; ; {
+		t -= math.Log(1.0-rng.Float64()) * step
+		if t >= t1 || collide(t, self.Density*self.Grid.Density(ray.PointAt(t))/majorant) {
+			return
+		}
+	}
+}
+
+func (self *GridVolume) HitBy(ray *Ray, tmin float64, tmax float64, record *HitRecord) bool {
+	if ray.Rng == nil {
+		return false
+	}
+	hit := false
+	self.collisions(ray.Rng, ray, tmin, tmax, func(t float64, ratio float64) bool {
+		if ray.Rng.Float64() >= ratio {
+			return false
+		}
+		record.t = t
+		record.point = ray.PointAt(t)
+		record.normal = ray.Direction.Unit().Scale(-1.0)
+		record.u, record.v = 0.0, 0.0
+		record.object = self
+		hit = true
+		return true
+	})
+	return hit
+}
+
+// Ratio tracking
+func (self *GridVolume) Transmittance(rng *rand.Rand, ray *Ray, tmin float64, tmax float64) float64 {
+	transmittance := 1.0
+	self.collisions(rng, ray, tmin, tmax, func(t float64, ratio float64) bool {
+		transmittance *= 1.0 - ratio
+		return transmittance <= 0.0
+	})
+	return math.Max(transmittance, 0.0)
+}
+
+func (self *GridVolume) GetMaterial() Material {
+	return self.Material
+}
+
+func (self *GridVolume) Update(t0 float64, t1 float64) {
+}
+
+func (self *GridVolume) BoundingBox() *AABB {
+	box := self.Grid.Box
+	return &box
+}
@@ -5,16 +5,28 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"math/rand"
+	"path/filepath"
 )
 
 type World struct {
+	Background       Background
+	Film             *Film
+	Fog              *Volume
 	Textures         map[string]Texture
 	Materials        map[string]Material
 	ValueAnimations  map[string]AnimatedValue
 	VectorAnimations map[string]AnimatedVector
+	Shapes           map[string]SceneObject
+	shapes           []SceneObject
 	Scene            struct {
-		Camera  *Camera
-		Objects []SceneObject
+		Camera   *Camera
+		Objects  []SceneObject
+		bvh      *BVH
+		lights   []sceneLight
+		lightSet map[lightKey][]SampledObject
+		media    []placedMedium
 	}
 }
 
@@ -34,21 +46,130 @@ type FileVector struct {
 	Anim string  `json:"anim"`
 }
 
+type FileColorStop struct {
+	Position float64    `json:"position"`
+	Color    [3]float64 `json:"color"`
+}
+
+type FileTexture struct {
+	Type       string          `json:"type"`
+	Name       string          `json:"name"`
+	Color      [3]float64      `json:"color"`
+	Size       float64         `json:"size"`
+	Texture1   string          `json:"texture1"`
+	Texture2   string          `json:"texture2"`
+	File       string          `json:"file"`
+	Wrap       string          `json:"wrap"`
+	Scale      float64         `json:"scale"`
+	Octaves    int             `json:"octaves"`
+	Seed       int64           `json:"seed"`
+	Distortion float64         `json:"distortion"`
+	Ramp       []FileColorStop `json:"ramp"`
+}
+
+// Transform steps are applied in order, each one holding a single operation
+type FileTransformStep struct {
+	Translate *[3]float64 `json:"translate"`
+	Rotate    *[3]float64 `json:"rotate"`
+	Angle     float64     `json:"angle"`
+	Scale     *[3]float64 `json:"scale"`
+}
+
+type FileSdf struct {
+	Type        string     `json:"type"`
+	Center      [3]float64 `json:"center"`
+	Size        [3]float64 `json:"size"`
+	Radius      float64    `json:"radius"`
+	MinorRadius float64    `json:"minorRadius"`
+	A           [3]float64 `json:"a"`
+	B           [3]float64 `json:"b"`
+	Smooth      float64    `json:"smooth"`
+	Rate        float64    `json:"rate"`
+	Period      [3]float64 `json:"period"`
+	Count       *[3]int    `json:"count"`
+	Children    []FileSdf  `json:"children"`
+}
+
+type FileGrid struct {
+	File       string      `json:"file"`
+	Resolution [3]int      `json:"resolution"`
+	Min        *[3]float64 `json:"min"`
+	Max        *[3]float64 `json:"max"`
+	Noise      bool        `json:"noise"`
+	Scale      float64     `json:"scale"`
+	Octaves    int         `json:"octaves"`
+	Seed       int64       `json:"seed"`
+}
+
+// Thickness in nanometers, scaled by the optional texture
+type FileThinFilm struct {
+	Thickness float64 `json:"thickness"`
+	Ior       float64 `json:"ior"`
+	Texture   string  `json:"texture"`
+}
+
+// Principled material parameters can be driven by the textures named in the
+// textures map, by parameter name
+type FileMaterial struct {
+	Name           string            `json:"name"`
+	Type           string            `json:"type"`
+	Texture        string            `json:"texture"`
+	Param          float64           `json:"param"`
+	Roughness      float64           `json:"roughness"`
+	Preset         string            `json:"preset"`
+	Eta            *[3]float64       `json:"eta"`
+	K              *[3]float64       `json:"k"`
+	Color          *[3]float64       `json:"color"`
+	Metallic       float64           `json:"metallic"`
+	Specular       *float64          `json:"specular"`
+	SpecularTint   float64           `json:"specularTint"`
+	Sheen          float64           `json:"sheen"`
+	SheenTint      float64           `json:"sheenTint"`
+	Clearcoat      float64           `json:"clearcoat"`
+	ClearcoatGloss *float64          `json:"clearcoatGloss"`
+	Transmission   float64           `json:"transmission"`
+	Ior            *float64          `json:"ior"`
+	MeanFreePath   *[3]float64       `json:"meanFreePath"`
+	Absorption     *[3]float64       `json:"absorption"`
+	Abbe           float64           `json:"abbe"`
+	Film           *FileThinFilm     `json:"film"`
+	Materials      []string          `json:"materials"`
+	Base           string            `json:"base"`
+	Textures       map[string]string `json:"textures"`
+}
+
+type FileObject struct {
+	Type      string              `json:"type"`
+	Name      string              `json:"name"`
+	Position  FileVector          `json:"position"`
+	Radius    FileValue           `json:"radius"`
+	Minor     float64             `json:"minorRadius"`
+	Height    float64             `json:"height"`
+	Open      bool                `json:"open"`
+	Operation string              `json:"operation"`
+	Shape     *FileSdf            `json:"shape"`
+	Density   float64             `json:"density"`
+	Grid      *FileGrid           `json:"grid"`
+	Material  string              `json:"material"`
+	Vertices  [][3]float64        `json:"vertices"`
+	Normals   [][3]float64        `json:"normals"`
+	UVs       [][2]float64        `json:"uvs"`
+	Indices   []int               `json:"indices"`
+	File      string              `json:"file"`
+	Normal    [3]float64          `json:"normal"`
+	Min       [3]float64          `json:"min"`
+	Max       [3]float64          `json:"max"`
+	Corner    *[3]float64         `json:"corner"`
+	Edge1     [3]float64          `json:"edge1"`
+	Edge2     [3]float64          `json:"edge2"`
+	Ref       string              `json:"ref"`
+	Objects   []FileObject        `json:"objects"`
+	Transform []FileTransformStep `json:"transform"`
+}
+
 type WorldFile struct {
-	Textures []struct {
-		Type     string     `json:"type"`
-		Name     string     `json:"name"`
-		Color    [3]float64 `json:"color"`
-		Size     float64    `json:"size"`
-		Texture1 string     `json:"texture1"`
-		Texture2 string     `json:"texture2"`
-	} `json:"textures"`
-	Materials []struct {
-		Name    string  `json:"name"`
-		Type    string  `json:"type"`
-		Texture string  `json:"texture"`
-		Param   float64 `json:"param"`
-	} `json:"materials"`
+	Textures   []FileTexture  `json:"textures"`
+	Materials  []FileMaterial `json:"materials"`
 	Animations []struct {
 		Name   string  `json:"name"`
 		Type   string  `json:"type"`
@@ -59,6 +180,25 @@ type WorldFile struct {
 		Speed  float64 `json:"speed"`
 		Scale  float64 `json:"scale"`
 	} `json:"animations"`
+	Background struct {
+		Type      string     `json:"type"`
+		Color     [3]float64 `json:"color"`
+		Bottom    [3]float64 `json:"bottom"`
+		Top       [3]float64 `json:"top"`
+		File      string     `json:"file"`
+		Intensity float64    `json:"intensity"`
+		Rotation  float64    `json:"rotation"`
+	} `json:"background"`
+	Film struct {
+		Exposure float64 `json:"exposure"`
+		ToneMap  string  `json:"tonemap"`
+		Gamma    float64 `json:"gamma"`
+	} `json:"film"`
+	Fog *struct {
+		Density    float64     `json:"density"`
+		Color      *[3]float64 `json:"color"`
+		Anisotropy float64     `json:"anisotropy"`
+	} `json:"fog"`
 	Scene struct {
 		Camera struct {
 			Position FileVector `json:"position"`
@@ -66,13 +206,10 @@ type WorldFile struct {
 			Up       FileVector `json:"up"`
 			Fov      FileValue  `json:"fov"`
 			Aperture FileValue  `json:"aperture"`
+			Shutter  [2]float64 `json:"shutter"`
 		} `json:"camera"`
-		Objects []struct {
-			Type     string     `json:"type"`
-			Position FileVector `json:"position"`
-			Radius   FileValue  `json:"radius"`
-			Material string     `json:"material"`
-		}
+		Shapes  []FileObject `json:"shapes"`
+		Objects []FileObject `json:"objects"`
 	} `json:"scene"`
 }
 
@@ -94,6 +231,370 @@ func (self *World) newAnimatedVector(v *FileVector) AnimatedVector {
 	return NewFixedVector3(v.X, v.Y, v.Z)
 }
 
+func newVector(value [3]float64) *Vector3 {
+	return NewVector(value[0], value[1], value[2])
+}
+
+func newVectors(values [][3]float64) []*Vector3 {
+	vectors := make([]*Vector3, len(values))
+	for i, v := range values {
+		vectors[i] = NewVector(v[0], v[1], v[2])
+	}
+	return vectors
+}
+
+func newUVs(values [][2]float64) []*Vector3 {
+	uvs := make([]*Vector3, len(values))
+	for i, uv := range values {
+		uvs[i] = NewVector(uv[0], uv[1], 0.0)
+	}
+	return uvs
+}
+
+// Relative paths are relative to the file referencing them, absolute ones are
+// kept
+func resolvePath(filename string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(filename), path)
+}
+
+// newObject creates a scene object, registering it as a shape when it is
+// named. It returns nil when the object description is invalid.
+func (self *World) newObject(objData *FileObject, filename string) SceneObject {
+	var obj SceneObject
+	switch objData.Type {
+	case "sphere":
+		if material, ok := self.Materials[objData.Material]; ok {
+			pos := self.newAnimatedVector(&objData.Position)
+			radius := self.newAnimatedValue(&objData.Radius)
+			obj = NewSphere(pos, radius, material)
+		} else {
+			fmt.Printf("Object material not found: '%s'\n", objData.Material)
+		}
+		break
+	case "triangle":
+		if material, ok := self.Materials[objData.Material]; ok {
+			if len(objData.Vertices) != 3 {
+				fmt.Println("Triangle must have 3 vertices")
+				break
+			}
+			vertices := newVectors(objData.Vertices)
+			if isDegenerate(vertices[0], vertices[1], vertices[2]) {
+				fmt.Println("Triangle vertices must not be aligned")
+				break
+			}
+			triangle := NewTriangle(vertices[0], vertices[1], vertices[2], material)
+			if len(objData.Normals) == 3 {
+				normals := newVectors(objData.Normals)
+				triangle.SetNormals(normals[0], normals[1], normals[2])
+			}
+			if len(objData.UVs) == 3 {
+				uvs := newUVs(objData.UVs)
+				triangle.SetUVs(uvs[0], uvs[1], uvs[2])
+			}
+			obj = triangle
+		} else {
+			fmt.Printf("Object material not found: '%s'\n", objData.Material)
+		}
+		break
+	case "plane":
+		if material, ok := self.Materials[objData.Material]; ok {
+			pos := self.newAnimatedVector(&objData.Position)
+			normal := NewVector(objData.Normal[0], objData.Normal[1], objData.Normal[2])
+			if normal.SquaredLength() == 0.0 {
+				normal = NewVector(0.0, 1.0, 0.0)
+			}
+			obj = NewPlane(pos, normal, material)
+		} else {
+			fmt.Printf("Object material not found: '%s'\n", objData.Material)
+		}
+		break
+	case "rect":
+		if material, ok := self.Materials[objData.Material]; ok {
+			if objData.Corner != nil {
+				quad := NewQuad(newVector(*objData.Corner), newVector(objData.Edge1), newVector(objData.Edge2), material)
+				if quad == nil {
+					fmt.Println("Rectangle edges must not be null nor parallel")
+					break
+				}
+				obj = quad
+			} else {
+				quad := NewAxisAlignedQuad(newVector(objData.Min), newVector(objData.Max), material)
+				if quad == nil {
+					fmt.Println("Rectangle corners must share exactly one coordinate")
+					break
+				}
+				obj = quad
+			}
+		} else {
+			fmt.Printf("Object material not found: '%s'\n", objData.Material)
+		}
+		break
+	case "box":
+		if material, ok := self.Materials[objData.Material]; ok {
+			box := NewBox(newVector(objData.Min), newVector(objData.Max), material)
+			if box == nil {
+				fmt.Println("Box corners must differ in every coordinate")
+				break
+			}
+			obj = box
+		} else {
+			fmt.Printf("Object material not found: '%s'\n", objData.Material)
+		}
+		break
+	case "disk":
+		if material, ok := self.Materials[objData.Material]; ok {
+			if objData.Radius.Value <= 0.0 {
+				fmt.Println("Disk radius must be positive")
+				break
+			}
+			obj = NewDisk(self.newAnimatedVector(&objData.Position), objData.Radius.Value, material)
+		} else {
+			fmt.Printf("Object material not found: '%s'\n", objData.Material)
+		}
+		break
+	case "cylinder":
+		if material, ok := self.Materials[objData.Material]; ok {
+			if objData.Radius.Value <= 0.0 || objData.Height <= 0.0 {
+				fmt.Println("Cylinder radius and height must be positive")
+				break
+			}
+			pos := self.newAnimatedVector(&objData.Position)
+			obj = NewCylinder(pos, objData.Radius.Value, objData.Height, !objData.Open, material)
+		} else {
+			fmt.Printf("Object material not found: '%s'\n", objData.Material)
+		}
+		break
+	case "cone":
+		if material, ok := self.Materials[objData.Material]; ok {
+			if objData.Radius.Value <= 0.0 || objData.Height <= 0.0 {
+				fmt.Println("Cone radius and height must be positive")
+				break
+			}
+			pos := self.newAnimatedVector(&objData.Position)
+			obj = NewCone(pos, objData.Radius.Value, objData.Height, !objData.Open, material)
+		} else {
+			fmt.Printf("Object material not found: '%s'\n", objData.Material)
+		}
+		break
+	case "torus":
+		if material, ok := self.Materials[objData.Material]; ok {
+			if objData.Radius.Value <= 0.0 || objData.Minor <= 0.0 {
+				fmt.Println("Torus radii must be positive")
+				break
+			}
+			pos := self.newAnimatedVector(&objData.Position)
+			obj = NewTorus(pos, objData.Radius.Value, objData.Minor, material)
+		} else {
+			fmt.Printf("Object material not found: '%s'\n", objData.Material)
+		}
+		break
+	case "mesh":
+		material, ok := self.Materials[objData.Material]
+		if len(objData.File) != 0 {
+			// Materials from the OBJ material library take precedence
+			mesh, err := LoadOBJ(resolvePath(filename, objData.File), material)
+			if err != nil {
+				fmt.Printf("Unable to load mesh: %v\n", err)
+			} else {
+				obj = mesh
+			}
+		} else if ok {
+			vertices := newVectors(objData.Vertices)
+			normals := newVectors(objData.Normals)
+			uvs := newUVs(objData.UVs)
+			hasNormals := len(normals) == len(vertices)
+			hasUVs := len(uvs) == len(vertices)
+			faces := []MeshFace{}
+			for i := 0; i+2 < len(objData.Indices); i += 3 {
+				face := MeshFace{Normals: [3]int{-1, -1, -1}, UVs: [3]int{-1, -1, -1}}
+				valid := true
+				for j := 0; j < 3; j++ {
+					index := objData.Indices[i+j]
+					if index < 0 || index >= len(vertices) {
+						valid = false
+						break
+					}
+					face.Vertices[j] = index
+					if hasNormals {
+						face.Normals[j] = index
+					}
+					if hasUVs {
+						face.UVs[j] = index
+					}
+				}
+				if valid {
+					faces = append(faces, face)
+				} else {
+					fmt.Printf("Invalid mesh face indices: %v\n", objData.Indices[i:i+3])
+				}
+			}
+			obj = NewMesh(vertices, normals, uvs, faces, material)
+		} else {
+			fmt.Printf("Object material not found: '%s'\n", objData.Material)
+		}
+		break
+	case "group":
+		objects := []SceneObject{}
+		for i := range objData.Objects {
+			if child := self.newObject(&objData.Objects[i], filename); child != nil {
+				objects = append(objects, child)
+			}
+		}
+		obj = NewGroup(objects)
+		break
+	case "sdf":
+		if material, ok := self.Materials[objData.Material]; ok {
+			if objData.Shape == nil {
+				fmt.Println("SDF object needs a shape")
+				break
+			}
+			if shape := NewSignedDistance(objData.Shape); shape != nil {
+				obj = NewSdfObject(self.newAnimatedVector(&objData.Position), shape, material)
+			}
+		} else {
+			fmt.Printf("Object material not found: '%s'\n", objData.Material)
+		}
+		break
+	case "volume":
+		if material, ok := self.Materials[objData.Material]; ok {
+			if objData.Grid != nil {
+				if grid := newDensityGrid(objData.Grid, filename); grid != nil {
+					obj = NewGridVolume(grid, objData.Density, material)
+				}
+				break
+			}
+			if len(objData.Objects) != 1 {
+				fmt.Println("Volume needs exactly 1 boundary object")
+				break
+			}
+			if boundary := self.newObject(&objData.Objects[0], filename); boundary != nil {
+				obj = NewVolume(boundary, objData.Density, material)
+			}
+		} else {
+			fmt.Printf("Object material not found: '%s'\n", objData.Material)
+		}
+		break
+	case "csg":
+		operation, ok := NewCsgOperation(objData.Operation)
+		if !ok {
+			fmt.Printf("Unknown CSG operation: '%s'\n", objData.Operation)
+			break
+		}
+		if len(objData.Objects) < 2 {
+			fmt.Println("CSG needs at least 2 objects")
+			break
+		}
+		// Optional: children keep their own materials otherwise
+		material := self.Materials[objData.Material]
+		if len(objData.Material) != 0 && material == nil {
+			fmt.Printf("Object material not found: '%s'\n", objData.Material)
+		}
+		// More than 2 objects are combined from left to right
+		var csg SceneObject
+		for i := range objData.Objects {
+			child := self.newObject(&objData.Objects[i], filename)
+			if child == nil {
+				csg = nil
+				break
+			}
+			if !isClosed(child) {
+				fmt.Printf("CSG objects must be closed: '%s'\n", objData.Objects[i].Type)
+				csg = nil
+				break
+			}
+			if csg == nil {
+				csg = child
+			} else {
+				csg = NewCsg(operation, csg, child, nil)
+			}
+		}
+		if csg != nil {
+			csg.(*Csg).Material = material
+			obj = csg
+		}
+		break
+	case "instance":
+		if shape, ok := self.Shapes[objData.Ref]; ok {
+			obj = NewInstance(shape, nil)
+		} else {
+			fmt.Printf("Instanced shape not found: '%s'\n", objData.Ref)
+		}
+		break
+	default:
+		fmt.Printf("Unknown object type: '%s'\n", objData.Type)
+		break
+	}
+	if obj == nil {
+		return nil
+	}
+	if len(objData.Transform) != 0 {
+		transform := newTransform(objData.Transform)
+		if transform == nil {
+			fmt.Println("Invalid object transform")
+			return nil
+		}
+		obj.SetTransform(transform)
+	}
+	if _, ok := obj.GetMaterial().(*SubsurfaceMaterial); ok && !isClosed(obj) {
+		fmt.Printf("Subsurface scattering needs a closed object: '%s'\n", objData.Type)
+	}
+	if len(objData.Name) != 0 {
+		self.Shapes[objData.Name] = obj
+	}
+	return obj
+}
+
+// The grid box is read from .vol files, otherwise it defaults to the unit box
+func newDensityGrid(data *FileGrid, filename string) *DensityGrid {
+	var grid *DensityGrid
+	if data.Noise {
+		resolution := data.Resolution[0]
+		if resolution <= 0 {
+			resolution = 64
+		}
+		scale := data.Scale
+		if scale == 0.0 {
+			scale = 2.0
+		}
+		octaves := data.Octaves
+		if octaves <= 0 {
+			octaves = 5
+		}
+		box := NewAABB(NewVector(0.0, 0.0, 0.0), NewVector(1.0, 1.0, 1.0))
+		grid = NewNoiseDensityGrid(resolution, box, scale, octaves, data.Seed)
+	} else {
+		var err error
+		grid, err = LoadDensityGrid(resolvePath(filename, data.File), data.Resolution)
+		if err != nil {
+			fmt.Printf("Unable to load density grid: %v\n", err)
+			return nil
+		}
+	}
+	if data.Min != nil && data.Max != nil {
+		grid.Box = *NewAABB(newVector(*data.Min), newVector(*data.Max))
+	}
+	return grid
+}
+
+func newTransform(steps []FileTransformStep) *Transform {
+	matrix := IdentityMatrix()
+	for _, step := range steps {
+		if step.Scale != nil {
+			matrix = ScaleMatrix(newVector(*step.Scale)).Multiply(matrix)
+		}
+		if step.Rotate != nil {
+			matrix = RotationMatrix(newVector(*step.Rotate), step.Angle).Multiply(matrix)
+		}
+		if step.Translate != nil {
+			matrix = TranslationMatrix(newVector(*step.Translate)).Multiply(matrix)
+		}
+	}
+	return NewTransform(matrix)
+}
+
 func (self *World) Load(filename string, aspectRatio float64) error {
 	bytes, _ := ioutil.ReadFile(filename)
 	worldFile := WorldFile{}
@@ -103,14 +604,77 @@ func (self *World) Load(filename string, aspectRatio float64) error {
 		return errors.New("Unable to parse JSON")
 	}
 
+	self.Background = NewGradientBackground(NewColor(1.0, 1.0, 1.0), NewColor(0.5, 0.7, 1.0))
+	bgData := &worldFile.Background
+	switch bgData.Type {
+	case "solid":
+		self.Background = NewSolidBackground(NewColor(bgData.Color[0], bgData.Color[1], bgData.Color[2]))
+		break
+	case "gradient":
+		self.Background = NewGradientBackground(NewColor(bgData.Bottom[0], bgData.Bottom[1], bgData.Bottom[2]), NewColor(bgData.Top[0], bgData.Top[1], bgData.Top[2]))
+		break
+	case "hdr":
+		img, err := LoadHDR(resolvePath(filename, bgData.File))
+		if err != nil {
+			fmt.Printf("Unable to load environment map: %v\n", err)
+			break
+		}
+		intensity := bgData.Intensity
+		if intensity == 0.0 {
+			intensity = 1.0
+		}
+		self.Background = NewEnvironmentMap(img, intensity, bgData.Rotation)
+		break
+	}
+
+	self.Film = NewFilm()
+	self.Film.Exposure = worldFile.Film.Exposure
+	self.Film.Gamma = worldFile.Film.Gamma
+	if len(worldFile.Film.ToneMap) != 0 {
+		toneMapping, ok := NewToneMapping(worldFile.Film.ToneMap)
+		if !ok {
+			fmt.Printf("Unknown tone mapping: '%s'\n", worldFile.Film.ToneMap)
+		}
+		self.Film.ToneMapping = toneMapping
+	}
+
+	self.Fog = nil
+	if fog := worldFile.Fog; fog != nil && fog.Density > 0.0 {
+		albedo := WhiteColor
+		if fog.Color != nil {
+			albedo = NewColor(fog.Color[0], fog.Color[1], fog.Color[2])
+		}
+		phase := NewPhaseMaterial(NewStaticTexture(albedo), fog.Anisotropy)
+		self.Fog = NewVolume(nil, fog.Density, phase)
+	}
+
 	self.Textures = make(map[string]Texture)
-	for _, texData := range worldFile.Textures {
-		self.Textures[texData.Name] = NewTexture(texData.Type, texData.Color, texData.Size, texData.Texture1, texData.Texture2, &self.Textures)
+	for i := range worldFile.Textures {
+		texData := &worldFile.Textures[i]
+		if texData.Type == "image" {
+			wrap, ok := NewWrapMode(texData.Wrap)
+			if !ok {
+				fmt.Printf("Unknown wrap mode: '%s'\n", texData.Wrap)
+				continue
+			}
+			texture, err := LoadImageTexture(resolvePath(filename, texData.File), wrap)
+			if err != nil {
+				fmt.Printf("Unable to load texture: %v\n", err)
+			} else {
+				self.Textures[texData.Name] = texture
+			}
+			continue
+		}
+		self.Textures[texData.Name] = NewTexture(texData, &self.Textures)
 	}
 	self.Materials = make(map[string]Material)
-	for _, matData := range worldFile.Materials {
-		texture := self.Textures[matData.Texture]
-		self.Materials[matData.Name] = NewMaterial(matData.Type, texture, matData.Param)
+	for i := range worldFile.Materials {
+		matData := &worldFile.Materials[i]
+		if material := NewMaterial(matData, &self.Textures, &self.Materials); material != nil {
+			self.Materials[matData.Name] = material
+		} else {
+			fmt.Printf("Invalid material: '%s'\n", matData.Name)
+		}
 	}
 	self.VectorAnimations = make(map[string]AnimatedVector)
 	self.ValueAnimations = make(map[string]AnimatedValue)
@@ -129,28 +693,192 @@ func (self *World) Load(filename string, aspectRatio float64) error {
 	camUp := self.newAnimatedVector(&worldFile.Scene.Camera.Up)
 	camFov := self.newAnimatedValue(&worldFile.Scene.Camera.Fov)
 	camAperture := self.newAnimatedValue(&worldFile.Scene.Camera.Aperture)
-	self.Scene.Camera = NewCamera(camPos, camLookAt, camUp, camFov, aspectRatio, camAperture)
-	for _, objData := range worldFile.Scene.Objects {
-		switch objData.Type {
-		case "sphere":
-			if material, ok := self.Materials[objData.Material]; ok {
-				pos := self.newAnimatedVector(&objData.Position)
-				radius := self.newAnimatedValue(&objData.Radius)
-				sphere := NewSphere(pos, radius, material)
-				self.Scene.Objects = append(self.Scene.Objects, sphere)
-			} else {
-				fmt.Printf("Object material not found: '%s'\n", objData.Material)
-			}
-			break
+	shutter := worldFile.Scene.Camera.Shutter
+	self.Scene.Camera = NewCamera(camPos, camLookAt, camUp, camFov, aspectRatio, camAperture, shutter[0], shutter[1])
+	self.Shapes = make(map[string]SceneObject)
+	self.shapes = nil
+	for i := range worldFile.Scene.Shapes {
+		objData := &worldFile.Scene.Shapes[i]
+		if len(objData.Name) == 0 {
+			fmt.Println("Shapes must be named")
+			continue
+		}
+		if obj := self.newObject(objData, filename); obj != nil {
+			self.shapes = append(self.shapes, obj)
+		}
+	}
+	for i := range worldFile.Scene.Objects {
+		if obj := self.newObject(&worldFile.Scene.Objects[i], filename); obj != nil {
+			self.Scene.Objects = append(self.Scene.Objects, obj)
 		}
 	}
 
 	return nil
 }
 
+// Update prepares the frame at time t. Objects are bounded over the whole
+// shutter interval.
 func (self *World) Update(t float64) {
-	self.Scene.Camera.Update(t)
+	t0, t1 := self.Scene.Camera.ShutterInterval(t)
+	self.Scene.Camera.Update(t0, t1)
 	for _, obj := range self.Scene.Objects {
-		obj.Update(t)
+		obj.Update(t0, t1)
+	}
+	// Shapes may only be referenced by instances, named scene objects are
+	// already updated with the scene
+	for _, shape := range self.shapes {
+		shape.Update(t0, t1)
+	}
+	// Animated objects move, so the hierarchy is rebuilt for each frame
+	self.Scene.bvh = NewBVH(self.Scene.Objects)
+	self.collectLights()
+	self.collectMedia()
+}
+
+func isEmissive(material Material) bool {
+	_, ok := material.(*EmissiveMaterial)
+	return ok
+}
+
+// Emissive objects which can be sampled are used for direct lighting.
+// Transformed ones are sampled in their object space.
+func (self *World) collectLights() {
+	self.Scene.lights = nil
+	self.Scene.lightSet = make(map[lightKey][]SampledObject)
+	for _, obj := range self.Scene.Objects {
+		root := obj
+		walkPrimitives(obj, nil, func(primitive SceneObject, transform *Transform) {
+			sampler, ok := primitive.(SampledObject)
+			if !ok || !isEmissive(primitive.GetMaterial()) {
+				return
+			}
+			if transform != nil {
+				sampler = newTransformedLight(sampler, transform)
+			}
+			key := lightKey{root, primitive}
+			self.Scene.lights = append(self.Scene.lights, sceneLight{key, sampler})
+			self.Scene.lightSet[key] = append(self.Scene.lightSet[key], sampler)
+		})
+	}
+}
+
+// walkPrimitives visits the primitives of an object, going down aggregates and
+// instances, with the transform from their object space to world space. The
+// transform is nil for primitives in world space.
+func walkPrimitives(obj SceneObject, transform *Transform, visit func(obj SceneObject, transform *Transform)) {
+	if own := obj.GetTransform(); own != nil {
+		if transform == nil {
+			transform = own
+		} else {
+			transform = own.Then(transform)
+		}
+	}
+	if instance, ok := obj.(*Instance); ok {
+		walkPrimitives(instance.Object, transform, visit)
+	} else if aggregate, ok := obj.(Aggregate); ok {
+		for _, primitive := range aggregate.Primitives() {
+			walkPrimitives(primitive, transform, visit)
+		}
+	} else {
+		visit(obj, transform)
+	}
+}
+
+// A medium with the transform from its object space to world space
+type placedMedium struct {
+	medium    Medium
+	transform *Transform
+}
+
+func (self *World) collectMedia() {
+	self.Scene.media = nil
+	for _, obj := range self.Scene.Objects {
+		walkPrimitives(obj, nil, func(primitive SceneObject, transform *Transform) {
+			if medium, ok := primitive.(Medium); ok {
+				self.Scene.media = append(self.Scene.media, placedMedium{medium, transform})
+			}
+		})
+	}
+}
+
+// A light primitive and the scene object it is part of, as recorded by hits.
+// Primitives instanced several times are told apart by the root, except for
+// instances gathered in the same scene object.
+type lightKey struct {
+	root   SceneObject
+	object SceneObject
+}
+
+// A light, and its sampler in world space
+type sceneLight struct {
+	lightKey
+	sampler SampledObject
+}
+
+// SampleLight picks a light uniformly and samples a direction toward it
+func (self *World) SampleLight(rng *rand.Rand, origin *Vector3, time float64) (light *sceneLight, direction *Vector3, pdf float64) {
+	count := len(self.Scene.lights)
+	if count == 0 {
+		return nil, nil, 0.0
+	}
+	picked := &self.Scene.lights[rng.Intn(count)]
+	direction, pdf = picked.sampler.SampleDirection(rng, origin, time)
+	if direction == nil || pdf <= 0.0 {
+		return nil, nil, 0.0
+	}
+	return picked, direction, pdf / float64(count)
+}
+
+// LightPdf is the pdf of SampleLight choosing the direction toward the hit
+// light, zero for objects which are not sampled as lights
+func (self *World) LightPdf(record *HitRecord, origin *Vector3, direction *Vector3, time float64) float64 {
+	samplers := self.Scene.lightSet[lightKey{record.root, record.object}]
+	if len(samplers) == 0 {
+		return 0.0
+	}
+	pdf := 0.0
+	for _, sampler := range samplers {
+		pdf += sampler.DirectionPdf(origin, direction, time)
+	}
+	return pdf / float64(len(self.Scene.lights))
+}
+
+// Without surface in front of it, a ray always scatters in the fog
+func (self *World) HitBy(ray *Ray, tmin float64, tmax float64, record *HitRecord) bool {
+	hit := self.Scene.bvh.HitBy(ray, tmin, tmax, record)
+	if self.Fog != nil {
+		if hit {
+			tmax = record.t
+		}
+		hit = self.Fog.HitBy(ray, tmin, tmax, record) || hit
+	}
+	return hit
+}
+
+// Visibility of the light along the shadow ray, attenuated by the media on the
+// way. Shadow rays have no generator, so media don't stop them.
+func (self *World) Visibility(rng *rand.Rand, ray *Ray, light *sceneLight, record *HitRecord) float64 {
+	if !self.HitBy(ray, 0.001, math.MaxFloat64, record) || record.object != light.object || record.root != light.root {
+		return 0.0
+	}
+	return self.Transmittance(rng, ray, 0.001, record.t)
+}
+
+// Transmittance of all the media along the ray between tmin and tmax
+func (self *World) Transmittance(rng *rand.Rand, ray *Ray, tmin float64, tmax float64) float64 {
+	transmittance := 1.0
+	if self.Fog != nil {
+		transmittance = self.Fog.Transmittance(rng, ray, tmin, tmax)
+	}
+	for _, placed := range self.Scene.media {
+		if transmittance <= 0.0 {
+			return 0.0
+		}
+		objectRay := ray
+		if placed.transform != nil {
+			objectRay = placed.transform.RayToObject(ray)
+		}
+		transmittance *= placed.medium.Transmittance(rng, objectRay, tmin, tmax)
 	}
+	return transmittance
 }